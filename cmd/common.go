@@ -0,0 +1,102 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	path "path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
+	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	images "github.com/MottainaiCI/simplestreams-builder/pkg/images"
+)
+
+// writeStreamsFile creates the file under the streams/v1 directory
+// of the target dir and writes the content through the writer function.
+// NOTE: Current LXD implementation has a static path for
+// index.json for path streams/v1 so I use always this
+// path for now.
+func writeStreamsFile(targetDir, name string, writer func(io.Writer) error) error {
+	f := fmt.Sprintf("%s/streams/v1/%s", strings.TrimRight(targetDir, "/"), name)
+
+	// Create target directory if doesn't exist.
+	if _, err := os.Stat(path.Dir(f)); os.IsNotExist(err) {
+		err = os.MkdirAll(path.Dir(f), 0760)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return fmt.Errorf("Error on create %s file: %s", name, err.Error())
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	err = writer(w)
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// addSkipFlags adds the flags used to control the products skipped
+// on metadata generation. The viper keys use the suffix in input.
+func addSkipFlags(cmd *cobra.Command, config *conf.BuilderTreeConfig, suffix string) {
+	var pflags = cmd.PersistentFlags()
+
+	pflags.Bool("strict", false, "Fail if a product is skipped.")
+	config.Viper.BindPFlag("strict-"+suffix, pflags.Lookup("strict"))
+	pflags.String("skip-report", "",
+		"Write the JSON report of the skipped products to the file (- for stderr).")
+	config.Viper.BindPFlag("skip-report-"+suffix, pflags.Lookup("skip-report"))
+	pflags.Int("max-skipped", -1,
+		"Fail if the skipped products are more than the value. Disabled if negative.")
+	config.Viper.BindPFlag("max-skipped-"+suffix, pflags.Lookup("max-skipped"))
+}
+
+// loadManifests loads the manifests of the products with the skip
+// options of the command and writes the report of the skipped
+// products if requested.
+func loadManifests(ctx context.Context, b *builder.Builder, sourceDir, suffix string) (*images.ManifestsSnapshot, error) {
+	var rerr error
+
+	snapshot, err := b.LoadManifests(ctx, builder.LoadManifestsOptions{
+		SourceDir:  sourceDir,
+		Strict:     b.Config.Viper.GetBool("strict-" + suffix),
+		MaxSkipped: b.Config.Viper.GetInt("max-skipped-" + suffix),
+	})
+	if snapshot == nil {
+		return nil, err
+	}
+
+	report := snapshot.SkipReport()
+	reportFile := b.Config.Viper.GetString("skip-report-" + suffix)
+
+	if reportFile == "-" {
+		rerr = images.WriteSkipReportJson(report, os.Stderr)
+	} else if reportFile != "" {
+		var file *os.File
+		file, rerr = os.OpenFile(reportFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if rerr != nil {
+			return nil, fmt.Errorf("Error on create skip report file: %s", rerr.Error())
+		}
+		defer file.Close()
+		rerr = images.WriteSkipReportJson(report, file)
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	return snapshot, err
+}
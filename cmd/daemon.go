@@ -0,0 +1,128 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
+	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+func newDaemonCommand(config *conf.BuilderTreeConfig) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "Build the products at the times of their schedule",
+		Long: `Build the products with a schedule (a cron expression) at the
+scheduled times and update ssb.json, images.json and index.json after
+every successful build. The runs are recorded on the history file, used
+also to find the runs missed while the daemon was stopped.
+On SIGHUP the configuration is reloaded without stopping the running builds.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if config.Viper.GetString("target-dir") == "" {
+				return builder.NewInvalidOptionsError("Missing target-dir option.")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := builder.NewDaemonOptions()
+
+			opts.Build.TargetDir = config.Viper.GetString("target-dir")
+			if config.Viper.GetString("source-dir-daemon") != "" {
+				opts.Build.SourceDir = config.Viper.GetString("source-dir-daemon")
+			}
+			opts.Build.ImageFilename = config.Viper.GetString("image-filename-daemon")
+			opts.Build.BuildLxc = !config.Viper.GetBool("skip-lxc-daemon")
+			opts.Build.BuildLxd = !config.Viper.GetBool("skip-lxd-daemon")
+			opts.Build.PurgeOldImages = !config.Viper.GetBool("skip-purge-daemon")
+			opts.Build.GracePeriod = config.Viper.GetDuration("grace-period-daemon")
+			opts.Build.DefinitionOverrides = config.Viper.GetBool("definition-overrides-daemon")
+			opts.Manifest.SkipMetadata = config.Viper.GetBool("skip-metadata-daemon")
+			opts.MaxConcurrent = config.Viper.GetInt("max-concurrent")
+			opts.MissedRuns = config.Viper.GetString("missed-runs")
+			opts.HistorySize = config.Viper.GetInt("history-size")
+			opts.HistoryFile = config.Viper.GetString("history-file")
+			if opts.HistoryFile == "" {
+				opts.HistoryFile = filepath.Join(
+					filepath.Dir(config.Viper.GetString("config")), "ssb-daemon-history.jsonl")
+			}
+
+			// SIGHUP reloads the configuration.
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGHUP)
+			defer signal.Stop(signals)
+
+			reload := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case <-signals:
+						select {
+						case reload <- struct{}{}:
+						case <-cmd.Context().Done():
+							return
+						}
+					case <-cmd.Context().Done():
+						return
+					}
+				}
+			}()
+			opts.Reload = reload
+			opts.LoadConfig = func() (*conf.BuilderTreeConfig, error) {
+				return reloadConfig(config)
+			}
+
+			return builder.New(config).Daemon(cmd.Context(), opts)
+		},
+	}
+
+	defaults := builder.NewDaemonOptions()
+
+	var pflags = cmd.PersistentFlags()
+	pflags.Int("max-concurrent", defaults.MaxConcurrent, "Max number of builds running at the same time.")
+	config.Viper.BindPFlag("max-concurrent", pflags.Lookup("max-concurrent"))
+	pflags.String("missed-runs", defaults.MissedRuns,
+		`Policy of the runs missed while the daemon was stopped
+or busy: run-once or skip.`)
+	config.Viper.BindPFlag("missed-runs", pflags.Lookup("missed-runs"))
+	pflags.String("history-file", "",
+		`File where write the history of the runs.
+Default is ssb-daemon-history.jsonl in the directory of the config file.`)
+	config.Viper.BindPFlag("history-file", pflags.Lookup("history-file"))
+	pflags.Int("history-size", defaults.HistorySize, "Number of runs of a product kept on the history.")
+	config.Viper.BindPFlag("history-size", pflags.Lookup("history-size"))
+	pflags.Bool("skip-purge", false, "Skip purge of old images.")
+	config.Viper.BindPFlag("skip-purge-daemon", pflags.Lookup("skip-purge"))
+	pflags.Bool("skip-lxc", false, "Skip build of LXC image")
+	config.Viper.BindPFlag("skip-lxc-daemon", pflags.Lookup("skip-lxc"))
+	pflags.Bool("skip-lxd", false, "Skip build of LXD image")
+	config.Viper.BindPFlag("skip-lxd-daemon", pflags.Lookup("skip-lxd"))
+	pflags.StringP("source-dir", "s", "",
+		`Directory where retrieve the image files.
+Default is the current directory.`)
+	config.Viper.BindPFlag("source-dir-daemon", pflags.Lookup("source-dir"))
+	pflags.StringP("image-filename", "i", "image.yaml",
+		`Name of the file used by distrobuilder.
+Default is image.yaml.`)
+	config.Viper.BindPFlag("image-filename-daemon", pflags.Lookup("image-filename"))
+	pflags.Duration("grace-period", 10*time.Second,
+		`Time to wait after the forward of SIGINT/SIGTERM to
+distrobuilder and hook processes before kill them.`)
+	config.Viper.BindPFlag("grace-period-daemon", pflags.Lookup("grace-period"))
+	pflags.Bool("definition-overrides", false,
+		`Pass arch, release and os of the product to
+distrobuilder as definition overrides.`)
+	config.Viper.BindPFlag("definition-overrides-daemon", pflags.Lookup("definition-overrides"))
+	pflags.Bool("skip-metadata", false, "Don't read metadata.yaml of the metadata tarballs.")
+	config.Viper.BindPFlag("skip-metadata-daemon", pflags.Lookup("skip-metadata"))
+
+	return cmd
+}
@@ -0,0 +1,82 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
+	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	images "github.com/MottainaiCI/simplestreams-builder/pkg/images"
+)
+
+// errDiffChanged is returned by the diff command when the two
+// trees are different. It's not logged as an error.
+var errDiffChanged = errors.New("differences found")
+
+func newDiffCommand(config *conf.BuilderTreeConfig) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "diff <old> <new>",
+		Short: "Compare two images.json files or two trees",
+		Long: `Compare two images.json files or two trees and report products,
+versions, items, aliases and support EOL changed.
+
+Every argument could be the path of an images.json file, an url
+or the directory of a tree (streams/v1/images.json is used).
+
+The command exits with 0 if there are no differences and with 6
+if something is changed. With --fail-on-items it exits with 6 only
+if an item of a version already published is changed.
+The configuration file is optional: it's used only for the http
+and auth settings used with the urls.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			oldImgs, err := images.LoadImagesJson(cmd.Context(), config, args[0])
+			if err != nil {
+				return builder.NewInvalidOptionsError(
+					"Error on load %s: %s", args[0], err.Error())
+			}
+
+			newImgs, err := images.LoadImagesJson(cmd.Context(), config, args[1])
+			if err != nil {
+				return builder.NewInvalidOptionsError(
+					"Error on load %s: %s", args[1], err.Error())
+			}
+
+			d := images.DiffImages(oldImgs, newImgs)
+			d.Old, d.New = args[0], args[1]
+
+			if config.Viper.GetBool("diff-json") {
+				err = images.WriteImagesDiffJson(d, os.Stdout)
+			} else {
+				err = images.WriteImagesDiffText(d, os.Stdout)
+			}
+			if err != nil {
+				return err
+			}
+
+			if config.Viper.GetBool("diff-fail-on-items") {
+				if d.ItemsChanged() {
+					return errDiffChanged
+				}
+			} else if d.Changed() {
+				return errDiffChanged
+			}
+
+			return nil
+		},
+	}
+
+	var pflags = cmd.PersistentFlags()
+	pflags.Bool("json", false, "Print the differences in JSON format.")
+	config.Viper.BindPFlag("diff-json", pflags.Lookup("json"))
+	pflags.Bool("fail-on-items", false,
+		"Exit with 6 only if an item of a version already published is changed.")
+	config.Viper.BindPFlag("diff-fail-on-items", pflags.Lookup("fail-on-items"))
+
+	return cmd
+}
@@ -20,17 +20,16 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
-	"bufio"
-	"fmt"
+	"io"
 	"os"
-	path "path/filepath"
-	"strings"
+	"path"
 
 	"github.com/spf13/cobra"
 
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
 	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
 	images "github.com/MottainaiCI/simplestreams-builder/pkg/images"
-	utils "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
+	index "github.com/MottainaiCI/simplestreams-builder/pkg/index"
 )
 
 func newBuildImagesFileCommand(config *conf.BuilderTreeConfig) *cobra.Command {
@@ -39,56 +38,86 @@ func newBuildImagesFileCommand(config *conf.BuilderTreeConfig) *cobra.Command {
 		Use:   "build-images-file",
 		Short: "Build images.json file of the tree",
 		Args:  cobra.NoArgs,
-		PreRun: func(cmd *cobra.Command, args []string) {
+		PreRunE: func(cmd *cobra.Command, args []string) error {
 			if config.Viper.Get("target-dir") == "" && !config.Viper.GetBool("stdout-image") {
-				fmt.Println("Missing target-dir or stdout option")
-				os.Exit(1)
+				return builder.NewInvalidOptionsError("Missing target-dir or stdout option")
 			} else if config.Viper.Get("target-dir") != "" && config.Viper.GetBool("stdout-image") {
-				fmt.Println("Use target-dir or stdout option, not both.")
-				os.Exit(1)
+				return builder.NewInvalidOptionsError("Use target-dir or stdout option, not both.")
 			}
 
+			return nil
 		},
-		Run: func(cmd *cobra.Command, args []string) {
-			var f, sourceDir string
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var sourceDir string
 			var err error
+			var b *builder.Builder = builder.New(config)
 
 			if config.Viper.Get("source-dir-images") != "" {
 				sourceDir = config.Viper.GetString("source-dir-images")
 			} else {
 				sourceDir = config.Viper.GetString("target-dir")
 			}
-			imgs, err := images.BuildImagesFile(config, sourceDir)
-			utils.CheckError(err)
 
-			if config.Viper.GetBool("stdout-image") {
-				images.WriteImagesJson(imgs, os.Stdout)
-			} else {
+			// Load the manifests one time and use the same snapshot
+			// for images.json and index.json.
+			snapshot, err := loadManifests(cmd.Context(), b, sourceDir, "images")
+			if err != nil {
+				return err
+			}
 
-				// Create target directory if doesn't exist.
-				// NOTE: Current LXD implementation has a static path for
-				// index.json for path streams/v1 so I use always this
-				// path for now.
-				f = fmt.Sprintf("%s/streams/v1/images.json",
-					strings.TrimRight(config.Viper.GetString("target-dir"), "/"))
+			imgs, err := b.BuildImages(cmd.Context(), snapshot, sourceDir)
+			if err != nil {
+				return err
+			}
 
-				if _, err := os.Stat(path.Dir(f)); os.IsNotExist(err) {
-					err = os.MkdirAll(path.Dir(f), 0760)
-					utils.CheckError(err)
+			metricsFile := config.Viper.GetString("metrics-file")
+			if metricsFile != "" {
+				m, err := b.Metrics(cmd.Context(), snapshot, sourceDir)
+				if err != nil {
+					return err
 				}
 
-				file, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+				err = images.WriteMetricsFile(m, metricsFile)
+				if err != nil {
+					return err
+				}
+			}
+
+			if config.Viper.GetBool("stdout-image") {
+				return images.WriteImagesJson(imgs, os.Stdout)
+			}
+
+			// The previous images.json is used to notify the
+			// versions added and removed.
+			oldImgs, _ := images.ReadImagesJson(path.Join(
+				config.Viper.GetString("target-dir"), "streams/v1/images.json"))
+
+			err = writeStreamsFile(config.Viper.GetString("target-dir"),
+				"images.json", func(w io.Writer) error {
+					return images.WriteImagesJson(imgs, w)
+				})
+			if err != nil {
+				return err
+			}
+
+			b.NotifyImagesChanges(cmd.Context(), oldImgs, imgs)
+
+			if config.Viper.GetBool("with-index") {
+				idx, err := b.BuildIndex(cmd.Context(), snapshot, sourceDir)
 				if err != nil {
-					fmt.Println("Error on create index file " + err.Error())
-					os.Exit(1)
+					return err
 				}
-				defer file.Close()
 
-				w := bufio.NewWriter(file)
-				err = images.WriteImagesJson(imgs, w)
-				utils.CheckError(err)
-				w.Flush()
+				err = writeStreamsFile(config.Viper.GetString("target-dir"),
+					"index.json", func(w io.Writer) error {
+						return index.WriteIndexJson(idx, w)
+					})
+				if err != nil {
+					return err
+				}
 			}
+
+			return nil
 		},
 	}
 
@@ -99,6 +128,13 @@ func newBuildImagesFileCommand(config *conf.BuilderTreeConfig) *cobra.Command {
 		`Directory where retrieve images manifests.
 If not set source-dir then target-dir is used.`)
 	config.Viper.BindPFlag("source-dir-images", pflags.Lookup("source-dir"))
+	pflags.Bool("with-index", false,
+		"Build also index.json file from the same manifests.")
+	config.Viper.BindPFlag("with-index", pflags.Lookup("with-index"))
+	pflags.String("metrics-file", "",
+		"Write the Prometheus metrics of the tree to the file.")
+	config.Viper.BindPFlag("metrics-file", pflags.Lookup("metrics-file"))
+	addSkipFlags(cmd, config, "images")
 
 	return cmd
 }
@@ -20,16 +20,14 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
-	"bufio"
-	"fmt"
+	"io"
 	"os"
-	path "path/filepath"
 
 	"github.com/spf13/cobra"
 
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
 	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
 	index "github.com/MottainaiCI/simplestreams-builder/pkg/index"
-	utils "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
 )
 
 func newBuildIndexCommand(config *conf.BuilderTreeConfig) *cobra.Command {
@@ -37,55 +35,43 @@ func newBuildIndexCommand(config *conf.BuilderTreeConfig) *cobra.Command {
 		Use:   "build-index",
 		Short: "Build index.json file of the tree",
 		Args:  cobra.NoArgs,
-		PreRun: func(cmd *cobra.Command, args []string) {
+		PreRunE: func(cmd *cobra.Command, args []string) error {
 			if config.Viper.Get("target-dir") == "" && !config.Viper.GetBool("stdout") {
-				fmt.Println("Missing target-dir or stdout option")
-				os.Exit(1)
+				return builder.NewInvalidOptionsError("Missing target-dir or stdout option")
 			} else if config.Viper.Get("target-dir") != "" && config.Viper.GetBool("stdout") {
-				fmt.Println("Use target-dir or stdout option, not both.")
-				os.Exit(1)
+				return builder.NewInvalidOptionsError("Use target-dir or stdout option, not both.")
 			}
 
+			return nil
 		},
-		Run: func(cmd *cobra.Command, args []string) {
-			var f, sourceDir string
-			var err error
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var sourceDir string
+			var b *builder.Builder = builder.New(config)
 
 			if config.Viper.Get("source-dir-index") != "" {
 				sourceDir = config.Viper.GetString("source-dir-index")
 			} else {
 				sourceDir = config.Viper.GetString("target-dir")
 			}
-			idx, err := index.BuildIndexStruct(config, sourceDir)
-			utils.CheckError(err)
 
-			if config.Viper.GetBool("stdout") {
-				index.WriteIndexJson(idx, os.Stdout)
-			} else {
-				// Create target directory if doesn't exist.
-				// NOTE: Current LXD implementation has a static path for
-				// index.json for path streams/v1 so I use always this
-				// path for now.
-				f = fmt.Sprintf("%s/streams/v1/index.json",
-					config.Viper.Get("target-dir"))
-
-				if _, err := os.Stat(path.Dir(f)); os.IsNotExist(err) {
-					err = os.MkdirAll(path.Dir(f), 0760)
-					utils.CheckError(err)
-				}
+			snapshot, err := loadManifests(cmd.Context(), b, sourceDir, "index")
+			if err != nil {
+				return err
+			}
 
-				file, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-				if err != nil {
-					fmt.Println("Error on create index file " + err.Error())
-					os.Exit(1)
-				}
-				defer file.Close()
+			idx, err := b.BuildIndex(cmd.Context(), snapshot, sourceDir)
+			if err != nil {
+				return err
+			}
 
-				w := bufio.NewWriter(file)
-				err = index.WriteIndexJson(idx, w)
-				utils.CheckError(err)
-				w.Flush()
+			if config.Viper.GetBool("stdout") {
+				return index.WriteIndexJson(idx, os.Stdout)
 			}
+
+			return writeStreamsFile(config.Viper.GetString("target-dir"),
+				"index.json", func(w io.Writer) error {
+					return index.WriteIndexJson(idx, w)
+				})
 		},
 	}
 
@@ -96,6 +82,7 @@ func newBuildIndexCommand(config *conf.BuilderTreeConfig) *cobra.Command {
 		`Directory where retrieve images manifests.
 If not set source-dir then target-dir is used.`)
 	config.Viper.BindPFlag("source-dir-index", pflags.Lookup("source-dir"))
+	addSkipFlags(cmd, config, "index")
 
 	return cmd
 }
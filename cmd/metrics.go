@@ -0,0 +1,64 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
+	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	images "github.com/MottainaiCI/simplestreams-builder/pkg/images"
+)
+
+func newMetricsCommand(config *conf.BuilderTreeConfig) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "metrics",
+		Short: "Write Prometheus metrics of the published tree",
+		Long: `Write the metrics of the published tree in the Prometheus text format.
+The file could be exposed through the textfile collector of node_exporter.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if config.Viper.GetString("target-dir") == "" &&
+				config.Viper.GetString("source-dir-metrics") == "" {
+				return builder.NewInvalidOptionsError("Missing target-dir or source-dir option")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var sourceDir string
+			var b *builder.Builder = builder.New(config)
+
+			if config.Viper.GetString("source-dir-metrics") != "" {
+				sourceDir = config.Viper.GetString("source-dir-metrics")
+			} else {
+				sourceDir = config.Viper.GetString("target-dir")
+			}
+
+			m, err := b.Metrics(cmd.Context(), nil, sourceDir)
+			if err != nil {
+				return err
+			}
+
+			output := config.Viper.GetString("metrics-output")
+			if output == "" || output == "-" {
+				return images.WriteMetricsText(m, os.Stdout)
+			}
+
+			return images.WriteMetricsFile(m, output)
+		},
+	}
+
+	var pflags = cmd.PersistentFlags()
+	pflags.StringP("source-dir", "s", "",
+		`Directory where retrieve images manifests.
+If not set source-dir then target-dir is used.`)
+	config.Viper.BindPFlag("source-dir-metrics", pflags.Lookup("source-dir"))
+	pflags.StringP("output", "o", "",
+		"File where write the metrics. Default is stdout.")
+	config.Viper.BindPFlag("metrics-output", pflags.Lookup("output"))
+
+	return cmd
+}
@@ -26,15 +26,33 @@ import (
 
 	"github.com/spf13/cobra"
 
-	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
 )
 
-func newPrintCommand(config *config.BuilderTreeConfig) *cobra.Command {
+func newPrintCommand(config *conf.BuilderTreeConfig) *cobra.Command {
 	var cmd = &cobra.Command{
 		Use:   "print",
 		Short: "Show configuration params",
 		Args:  cobra.NoArgs,
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			if config.Viper.GetBool("print-yaml") {
+				// Print the configuration resolved with the includes,
+				// the products.d files and the values.
+				tree, err := conf.LoadTree(config.Viper.GetString("config"),
+					config.Viper.GetStringSlice("values-file"))
+				if err != nil {
+					return err
+				}
+
+				data, err := tree.Marshal()
+				if err != nil {
+					return err
+				}
+
+				fmt.Print(string(data))
+				return nil
+			}
 
 			fmt.Println("===================================")
 			fmt.Println("CONFIGURATION PARAMS:")
@@ -45,8 +63,15 @@ func newPrintCommand(config *config.BuilderTreeConfig) *cobra.Command {
 			fmt.Println("===================================")
 			fmt.Println("Config File: ", config.Viper.Get("config"))
 			fmt.Println("===================================")
+
+			return nil
 		},
 	}
 
+	var pflags = cmd.PersistentFlags()
+	pflags.Bool("yaml", false,
+		"Print the resolved configuration in YAML format with the source file of every product.")
+	config.Viper.BindPFlag("print-yaml", pflags.Lookup("yaml"))
+
 	return cmd
 }
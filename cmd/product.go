@@ -20,16 +20,14 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
-	"fmt"
-	"os"
-	"path"
-	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
 	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
 	images "github.com/MottainaiCI/simplestreams-builder/pkg/images"
-	utils "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
 )
 
 func newBuildProductCommand(config *conf.BuilderTreeConfig) *cobra.Command {
@@ -37,77 +35,48 @@ func newBuildProductCommand(config *conf.BuilderTreeConfig) *cobra.Command {
 		Use:   "build-product <name>",
 		Short: "Build product image and purge old images.",
 		Args:  cobra.RangeArgs(1, 1),
-		PreRun: func(cmd *cobra.Command, args []string) {
+		PreRunE: func(cmd *cobra.Command, args []string) error {
 			if config.Viper.Get("target-dir") == "" {
-				fmt.Println("Missing target-dir option")
-				os.Exit(1)
+				return builder.NewInvalidOptionsError("Missing target-dir option")
 			}
 
 			if args[0] == "" {
-				fmt.Println("Missing product name.")
-				os.Exit(1)
+				return builder.NewInvalidOptionsError("Missing product name.")
 			}
+
+			return nil
 		},
-		Run: func(cmd *cobra.Command, args []string) {
-			var ssp *conf.SimpleStreamsProduct = nil
-			var err error
-			var name string = args[0]
-			var sourceDir, imageFile string
-			var opts *images.BuildProductOpts = nil
-
-			for _, p := range config.Products {
-				if p.Name == name {
-					ssp = &p
-					break
-				}
-			}
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var opts builder.BuildProductOptions = builder.NewBuildProductOptions()
 
-			if ssp == nil {
-				fmt.Println("No product found with name " + name)
-				os.Exit(1)
+			opts.TargetDir = config.Viper.GetString("target-dir")
+			if config.Viper.GetString("source-dir-product") != "" {
+				opts.SourceDir = config.Viper.GetString("source-dir-product")
 			}
+			opts.ImageFilename = config.Viper.GetString("image-filename")
+			opts.BuildLxc = !config.Viper.GetBool("skip-lxc")
+			opts.BuildLxd = !config.Viper.GetBool("skip-lxd")
+			opts.PurgeOldImages = !config.Viper.GetBool("skip-purge")
+			opts.GracePeriod = config.Viper.GetDuration("grace-period")
+			opts.DefinitionOverrides = config.Viper.GetBool("definition-overrides")
 
-			if config.Viper.GetString("source-dir-product") == "" {
-				sourceDir = "."
-			} else {
-				sourceDir = config.Viper.GetString("source-dir-product")
+			reportFile := config.Viper.GetString("report")
+			if reportFile != "" {
+				opts.Report = images.NewBuildReport(args[0])
 			}
 
-			imageFile = fmt.Sprintf("%s/%s",
-				strings.TrimRight(path.Join(sourceDir, ssp.Directory), "/"),
-				config.Viper.GetString("image-filename"),
-			)
-
-			if _, err = os.Stat(imageFile); os.IsNotExist(err) {
-				fmt.Println(fmt.Sprintf(
-					"For product %s no %s file found on path %s. I try to current path.",
-					name, config.Viper.GetString("image-filename"), imageFile))
-
-				imageFile = fmt.Sprintf("%s/%s",
-					strings.TrimRight(sourceDir, "/"),
-					config.Viper.GetString("image-filename"),
-				)
-
-				if _, err = os.Stat(imageFile); os.IsNotExist(err) {
-					fmt.Println(fmt.Sprintf(
-						"No %s file found for product %s.",
-						config.Viper.GetString("image-filename"), name))
-					os.Exit(1)
+			err := builder.New(config).BuildProduct(cmd.Context(), args[0], opts)
+
+			if reportFile != "" {
+				// The report is written also on failure.
+				rerr := opts.Report.WriteJsonFile(reportFile)
+				if rerr != nil {
+					logger.Errorf("Error on write build report %s: %s",
+						reportFile, rerr.Error())
 				}
 			}
 
-			opts = images.NewBuildProductOpts()
-			opts.BuildLxc = !config.Viper.GetBool("skip-lxc")
-			opts.BuildLxd = !config.Viper.GetBool("skip-lxd")
-			opts.PurgeOldImages = !config.Viper.GetBool("skip-purge")
-
-			err = images.BuildProduct(ssp,
-				config.Viper.GetString("target-dir"),
-				imageFile,
-				opts,
-			)
-			utils.CheckError(err)
-
+			return err
 		},
 	}
 
@@ -126,6 +95,16 @@ If not set source-dir then target-dir is used.`)
 		`Name of the file used by distrobuilder.
 Default is image.yaml.`)
 	config.Viper.BindPFlag("image-filename", pflags.Lookup("image-filename"))
+	pflags.Duration("grace-period", 10*time.Second,
+		`Time to wait after the forward of SIGINT/SIGTERM to
+distrobuilder and hook processes before kill them.`)
+	config.Viper.BindPFlag("grace-period", pflags.Lookup("grace-period"))
+	pflags.String("report", "", "Write the JSON report of the build to the file.")
+	config.Viper.BindPFlag("report", pflags.Lookup("report"))
+	pflags.Bool("definition-overrides", false,
+		`Pass arch, release and os of the product to
+distrobuilder as definition overrides.`)
+	config.Viper.BindPFlag("definition-overrides", pflags.Lookup("definition-overrides"))
 
 	return cmd
 }
@@ -0,0 +1,59 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
+	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+func newRenderDefinitionCommand(config *conf.BuilderTreeConfig) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "render-definition <name>",
+		Short: "Print the image file of the product rendered from the template.",
+		Long: `Print the distrobuilder file used to build the product.
+If the image file is a template (suffix .tmpl) it's rendered with
+the fields and the vars of the product, like build-product does.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var buf bytes.Buffer
+
+			err := builder.New(config).RenderDefinition(args[0],
+				config.Viper.GetString("source-dir-render"),
+				config.Viper.GetString("image-filename-render"), &buf)
+			if err != nil {
+				return err
+			}
+
+			output := config.Viper.GetString("render-output")
+			if output == "" || output == "-" {
+				_, err = os.Stdout.Write(buf.Bytes())
+				return err
+			}
+
+			return ioutil.WriteFile(output, buf.Bytes(), 0644)
+		},
+	}
+
+	var pflags = cmd.PersistentFlags()
+	pflags.StringP("source-dir", "s", "",
+		`Directory where retrieve the image files.
+Default is the current directory.`)
+	config.Viper.BindPFlag("source-dir-render", pflags.Lookup("source-dir"))
+	pflags.StringP("image-filename", "i", "image.yaml",
+		`Name of the file used by distrobuilder.
+If not available, the file with suffix .tmpl is used.`)
+	config.Viper.BindPFlag("image-filename-render", pflags.Lookup("image-filename"))
+	pflags.StringP("output", "o", "",
+		"File where write the definition. Default is stdout.")
+	config.Viper.BindPFlag("render-output", pflags.Lookup("output"))
+
+	return cmd
+}
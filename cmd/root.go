@@ -20,14 +20,20 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
 	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
-	utils "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
+	images "github.com/MottainaiCI/simplestreams-builder/pkg/images"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+	tools "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
 )
 
 const (
@@ -55,6 +61,20 @@ func initConfig(config *conf.BuilderTreeConfig) {
 	config.Viper.SetTypeByDefaultValue(true)
 }
 
+// initLogger configures the logger. The logs are always written
+// to stderr so stdout contains only the output requested.
+func initLogger(config *conf.BuilderTreeConfig) {
+	logger.SetJSON(config.Viper.GetBool("log-json"))
+
+	if config.Viper.GetBool("verbose") {
+		logger.SetLevel(logger.DebugLevel)
+	} else if config.Viper.GetBool("quiet") {
+		logger.SetLevel(logger.WarningLevel)
+	} else {
+		logger.SetLevel(logger.InfoLevel)
+	}
+}
+
 func initCommand(rootCmd *cobra.Command, config *conf.BuilderTreeConfig) {
 	var pflags = rootCmd.PersistentFlags()
 
@@ -66,15 +86,140 @@ func initCommand(rootCmd *cobra.Command, config *conf.BuilderTreeConfig) {
 	config.Viper.BindPFlag("target-dir", pflags.Lookup("target-dir"))
 	config.Viper.BindPFlag("apikey", pflags.Lookup("apikey"))
 
+	pflags.StringSlice("values-file", []string{},
+		"YAML file with the values used for the interpolation of the configuration.")
+	config.Viper.BindPFlag("values-file", pflags.Lookup("values-file"))
+
+	pflags.BoolP("quiet", "q", false, "Show only warnings and errors.")
+	pflags.Bool("verbose", false, "Show debug messages.")
+	pflags.Bool("log-json", false, "Write logs in JSON format.")
+
+	config.Viper.BindPFlag("quiet", pflags.Lookup("quiet"))
+	config.Viper.BindPFlag("verbose", pflags.Lookup("verbose"))
+	config.Viper.BindPFlag("log-json", pflags.Lookup("log-json"))
+
 	rootCmd.AddCommand(
 		newPrintCommand(config),
 		newBuildIndexCommand(config),
 		newBuildVersionsManifestCommand(config),
 		newBuildImagesFileCommand(config),
 		newBuildProductCommand(config),
+		newMetricsCommand(config),
+		newDiffCommand(config),
+		newValidateConfigCommand(config),
+		newRenderDefinitionCommand(config),
+		newWatchCommand(config),
+		newDaemonCommand(config),
 	)
 }
 
+// Exit codes of the CLI.
+const (
+	ExitOk              = 0
+	ExitError           = 1
+	ExitInvalidOptions  = 2
+	ExitProductNotFound = 3
+	ExitManifestInvalid = 4
+	ExitBuildFailed     = 5
+	ExitDiffChanged     = 6
+	ExitInterrupted     = 130
+)
+
+// exitCode returns the exit code related to the error.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOk
+	case errors.Is(err, errDiffChanged):
+		return ExitDiffChanged
+	case errors.Is(err, context.Canceled):
+		return ExitInterrupted
+	case errors.Is(err, builder.ErrInvalidOptions):
+		return ExitInvalidOptions
+	case errors.Is(err, builder.ErrProductNotFound):
+		return ExitProductNotFound
+	case errors.Is(err, builder.ErrManifestInvalid):
+		return ExitManifestInvalid
+	case errors.Is(err, builder.ErrBuildFailed):
+		return ExitBuildFailed
+	}
+	return ExitError
+}
+
+// loadConfig validates and loads the configuration file with the
+// products completed from the image files and the aliases expanded.
+func loadConfig(config *conf.BuilderTreeConfig) error {
+	problems, err := conf.ValidateFile(config.Viper.GetString("config"),
+		conf.ValidateOptions{
+			ExtraKeys:   configExtraKeys,
+			ValuesFiles: config.Viper.GetStringSlice("values-file"),
+		})
+	if err != nil {
+		return builder.NewInvalidOptionsError("%s", err.Error())
+	}
+	if len(problems) > 0 {
+		return &builder.Error{
+			Kind: builder.ErrInvalidOptions,
+			Err:  &conf.ValidationError{Problems: problems},
+		}
+	}
+
+	config.Viper.SetConfigType("yml")
+	config.Viper.SetConfigFile(config.Viper.Get("config").(string))
+
+	// Parse configuration file
+	err = config.Unmarshal()
+	if err != nil {
+		return builder.NewInvalidOptionsError(
+			"Error on parse configuration file: %s", err.Error())
+	}
+
+	// Fill the fields of the products not defined with the
+	// values of the image files.
+	images.CompleteProducts(config)
+
+	err = config.ExpandAliases()
+	if err != nil {
+		return builder.NewInvalidOptionsError(
+			"Error on parse configuration file: %s", err.Error())
+	}
+
+	return nil
+}
+
+// loadDiffConfig loads the configuration file without the validation,
+// the completion of the products and the expansion of the aliases.
+func loadDiffConfig(config *conf.BuilderTreeConfig) error {
+	config.Viper.SetConfigType("yml")
+	config.Viper.SetConfigFile(config.Viper.GetString("config"))
+
+	err := config.Unmarshal()
+	if err != nil {
+		return builder.NewInvalidOptionsError(
+			"Error on parse configuration file: %s", err.Error())
+	}
+
+	return nil
+}
+
+// reloadConfig loads the configuration file used by config on a new
+// config. It's used to reload the configuration without restart.
+func reloadConfig(config *conf.BuilderTreeConfig) (*conf.BuilderTreeConfig, error) {
+	var ans *conf.BuilderTreeConfig = conf.NewBuilderTreeConfig(nil)
+
+	initConfig(ans)
+	for _, key := range []string{"config", "values-file", "apikey"} {
+		ans.Viper.Set(key, config.Viper.Get(key))
+	}
+
+	err := loadConfig(ans)
+	if err != nil {
+		return nil, err
+	}
+
+	return ans, nil
+}
+
 func Execute() {
 	// Create Main Instance Config object
 	var config *conf.BuilderTreeConfig = conf.NewBuilderTreeConfig(nil)
@@ -82,40 +227,63 @@ func Execute() {
 	initConfig(config)
 
 	var rootCmd = &cobra.Command{
-		Short:        cliName,
-		Version:      fmt.Sprintf("%s-g%s %s", SSB_VERSION, BuildCommit, BuildTime),
-		Args:         cobra.OnlyValidArgs,
-		SilenceUsage: true,
-		PreRun: func(cmd *cobra.Command, args []string) {
+		Short:         cliName,
+		Version:       fmt.Sprintf("%s-g%s %s", SSB_VERSION, BuildCommit, BuildTime),
+		Args:          cobra.OnlyValidArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) == 0 {
-				cmd.Help()
-				os.Exit(0)
+				return cmd.Help()
 			}
+			return nil
 		},
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			var err error
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			var v *viper.Viper = config.Viper
 
+			initLogger(config)
+
+			// The diff command compares images.json files and
+			// uses only the http and auth settings of the tree.
+			// The configuration is optional and not validated.
+			if cmd.Name() == "diff" {
+				if v.GetString("config") == "" {
+					return nil
+				}
+				return loadDiffConfig(config)
+			}
+
 			if v.Get("config") == "" {
-				fmt.Println("Missing configuration file")
-				os.Exit(1)
+				return builder.NewInvalidOptionsError("Missing configuration file")
 			}
 
-			v.SetConfigType("yml")
-			v.SetConfigFile(v.Get("config").(string))
+			// The validate-config command executes all checks itself
+			// and it doesn't need the configuration loaded.
+			if cmd.Name() == "validate-config" {
+				return nil
+			}
 
-			// Parse configuration file
-			err = config.Unmarshal()
-			utils.CheckError(err)
+			return loadConfig(config)
 		},
 	}
 
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return builder.NewInvalidOptionsError("%s", err.Error())
+	})
+
 	initCommand(rootCmd, config)
 
+	// The commands are cancelled on SIGINT/SIGTERM so that the child
+	// processes are stopped and the partial directories removed.
+	ctx, cancel := tools.NotifyContext(context.Background(),
+		syscall.SIGINT, syscall.SIGTERM)
+
 	// Start command execution
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	err := rootCmd.ExecuteContext(ctx)
+	cancel()
+	if err != nil && !errors.Is(err, errDiffChanged) {
+		logger.Error(err)
 	}
 
+	os.Exit(exitCode(err))
 }
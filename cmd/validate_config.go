@@ -0,0 +1,82 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
+	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+func newValidateConfigCommand(config *conf.BuilderTreeConfig) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "validate-config",
+		Short: "Validate the configuration file",
+		Long: `Validate the configuration file and report all problems with
+the line numbers: unknown keys, invalid values, missing required fields,
+duplicate product names and directories, invalid urls, missing
+hook scripts and auth files.
+
+With --source-dir the image files of the local products are checked too.
+
+The same checks, except the checks of the files, are executed
+by every command before loading the configuration.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			problems, err := conf.ValidateFile(config.Viper.GetString("config"),
+				conf.ValidateOptions{
+					ExtraKeys:     configExtraKeys,
+					CheckFiles:    true,
+					SourceDir:     config.Viper.GetString("source-dir-validate"),
+					ImageFilename: config.Viper.GetString("image-filename-validate"),
+					ValuesFiles:   config.Viper.GetStringSlice("values-file"),
+				})
+			if err != nil {
+				return builder.NewInvalidOptionsError("%s", err.Error())
+			}
+
+			if config.Viper.GetBool("validate-json") {
+				data, err := json.MarshalIndent(problems, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(data))
+			} else if len(problems) == 0 {
+				fmt.Printf("%s: configuration is valid.\n", config.Viper.GetString("config"))
+			} else {
+				for _, p := range problems {
+					fmt.Fprintln(os.Stdout, p.String())
+				}
+			}
+
+			if len(problems) > 0 {
+				return builder.NewInvalidOptionsError(
+					"Found %d problems on configuration file", len(problems))
+			}
+
+			return nil
+		},
+	}
+
+	var pflags = cmd.PersistentFlags()
+	pflags.StringP("source-dir", "s", "",
+		"Directory where check the image files of the local products.")
+	config.Viper.BindPFlag("source-dir-validate", pflags.Lookup("source-dir"))
+	pflags.StringP("image-filename", "i", "image.yaml",
+		"Name of the file used by distrobuilder.")
+	config.Viper.BindPFlag("image-filename-validate", pflags.Lookup("image-filename"))
+	pflags.Bool("json", false, "Print the problems in JSON format.")
+	config.Viper.BindPFlag("validate-json", pflags.Lookup("json"))
+
+	return cmd
+}
+
+// configExtraKeys contains the keys of the global flags that
+// could be defined also on the configuration file.
+var configExtraKeys = []string{"apikey", "target-dir"}
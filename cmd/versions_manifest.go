@@ -28,9 +28,9 @@ import (
 
 	"github.com/spf13/cobra"
 
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
 	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
 	images "github.com/MottainaiCI/simplestreams-builder/pkg/images"
-	utils "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
 )
 
 func newBuildVersionsManifestCommand(config *conf.BuilderTreeConfig) *cobra.Command {
@@ -39,77 +39,73 @@ func newBuildVersionsManifestCommand(config *conf.BuilderTreeConfig) *cobra.Comm
 		Use:   "build-versions-manifest",
 		Short: "Build ssb.json file of one product",
 		Args:  cobra.NoArgs,
-		PreRun: func(cmd *cobra.Command, args []string) {
+		PreRunE: func(cmd *cobra.Command, args []string) error {
 			if config.Viper.Get("product") == "" {
-				fmt.Println("No product choice.")
-				os.Exit(1)
+				return builder.NewInvalidOptionsError("No product choice.")
 			}
 			if config.Viper.Get("source-dir") == "" {
-				fmt.Println("Missing source-dir option.")
-				os.Exit(1)
+				return builder.NewInvalidOptionsError("Missing source-dir option.")
 			}
+			return nil
 		},
-		Run: func(cmd *cobra.Command, args []string) {
-			var ssp *conf.SimpleStreamsProduct = nil
-			var productDir, f string
-
-			for _, p := range config.Products {
-				if p.Name == config.Viper.Get("product") {
-					ssp = &p
-					break
-				}
-			}
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var f string
+			var b *builder.Builder = builder.New(config)
 
-			if ssp == nil {
-				fmt.Println("No product found with name " + config.Viper.GetString("product"))
-				os.Exit(1)
+			ssp, err := b.Product(config.Viper.GetString("product"))
+			if err != nil {
+				return err
 			}
 
-			productDir = fmt.Sprintf("%s/%s", config.Viper.Get("source-dir"),
-				ssp.Directory)
-
-			manifest, err := images.BuildVersionsManifest(ssp, images.BuildVersionsManifestOptions{
-				ProductDir:          productDir,
-				PrefixPath:          config.Prefix,
-				ImageFile:           config.Viper.GetString("product-image-file"),
-				ForceExpireDuration: config.Viper.GetString("force-expire"),
+			manifest, err := b.BuildManifest(cmd.Context(), ssp.Name, builder.BuildManifestOptions{
+				SourceDir:         config.Viper.GetString("source-dir"),
+				ImageFile:         config.Viper.GetString("product-image-file"),
+				ForceExpire:       config.Viper.GetString("force-expire"),
+				SkipMetadata:      config.Viper.GetBool("skip-metadata"),
+				StrictMetadata:    config.Viper.GetBool("strict-metadata"),
+				IncludeIncomplete: config.Viper.GetBool("include-incomplete"),
 			})
-			utils.CheckError(err)
+			if err != nil {
+				return err
+			}
 
 			if config.Viper.GetBool("stdout-manifest") {
-				images.WriteVersionsManifestJson(manifest, os.Stdout)
-			} else {
-
-				if config.Viper.Get("target-dir") != "" {
-					f = fmt.Sprintf("%s/ssb.json",
-						strings.TrimRight(
-							path.Join(config.Viper.GetString("target-dir"), ssp.Directory),
-							"/",
-						),
-					)
-				} else {
-					// I write files under source dir
-					f = fmt.Sprintf("%s/ssb.json", productDir)
-				}
+				return images.WriteVersionsManifestJson(manifest, os.Stdout)
+			}
 
-				if _, err := os.Stat(path.Dir(f)); os.IsNotExist(err) {
-					err = os.MkdirAll(path.Dir(f), 0760)
-					utils.CheckError(err)
-				}
+			if config.Viper.Get("target-dir") != "" {
+				f = fmt.Sprintf("%s/ssb.json",
+					strings.TrimRight(
+						path.Join(config.Viper.GetString("target-dir"), ssp.Directory),
+						"/",
+					),
+				)
+			} else {
+				// I write files under source dir
+				f = fmt.Sprintf("%s/%s/ssb.json",
+					config.Viper.GetString("source-dir"), ssp.Directory)
+			}
 
-				file, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+			if _, err := os.Stat(path.Dir(f)); os.IsNotExist(err) {
+				err = os.MkdirAll(path.Dir(f), 0760)
 				if err != nil {
-					fmt.Println("Error on create index file " + err.Error())
-					os.Exit(1)
+					return err
 				}
-				defer file.Close()
+			}
+
+			file, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+			if err != nil {
+				return fmt.Errorf("Error on create ssb.json file: %s", err.Error())
+			}
+			defer file.Close()
 
-				w := bufio.NewWriter(file)
-				err = images.WriteVersionsManifestJson(manifest, w)
-				utils.CheckError(err)
-				w.Flush()
+			w := bufio.NewWriter(file)
+			err = images.WriteVersionsManifestJson(manifest, w)
+			if err != nil {
+				return err
 			}
 
+			return w.Flush()
 		},
 	}
 
@@ -122,6 +118,14 @@ func newBuildVersionsManifestCommand(config *conf.BuilderTreeConfig) *cobra.Comm
 	config.Viper.BindPFlag("source-dir", pflags.Lookup("source-dir"))
 	pflags.StringP("force-expire", "e", "", "Force expire duration and ignore image file.")
 	config.Viper.BindPFlag("force-expire", pflags.Lookup("force-expire"))
+	pflags.Bool("skip-metadata", false, "Don't read metadata.yaml of the metadata tarballs.")
+	config.Viper.BindPFlag("skip-metadata", pflags.Lookup("skip-metadata"))
+	pflags.Bool("strict-metadata", false,
+		"Fail if metadata.yaml is not available, not readable or doesn't match with the product.")
+	config.Viper.BindPFlag("strict-metadata", pflags.Lookup("strict-metadata"))
+	pflags.Bool("include-incomplete", false,
+		"Include also the versions without the items required by the product.")
+	config.Viper.BindPFlag("include-incomplete", pflags.Lookup("include-incomplete"))
 	pflags.StringP("product-image-file", "i", "",
 		`Name of the file used by distrobuilder.
 Default is image.yaml.`)
@@ -0,0 +1,61 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	builder "github.com/MottainaiCI/simplestreams-builder/pkg/builder"
+	conf "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+func newWatchCommand(config *conf.BuilderTreeConfig) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "watch",
+		Short: "Regenerate the metadata when the product directories change",
+		Long: `Watch the directories of the products under target-dir, for example
+populated by rsync from other hosts. When the version directories of a
+product don't change for the debounce time the ssb.json of the product
+is regenerated and then images.json and index.json.
+The incomplete versions are skipped until all items are available.
+inotify is used when available, otherwise the directories are polled.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if config.Viper.GetString("target-dir") == "" {
+				return builder.NewInvalidOptionsError("Missing target-dir option.")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := builder.NewWatchOptions()
+			opts.TargetDir = config.Viper.GetString("target-dir")
+			opts.Debounce = config.Viper.GetDuration("watch-debounce")
+			opts.PollInterval = config.Viper.GetDuration("watch-poll-interval")
+			opts.Poll = config.Viper.GetBool("watch-poll")
+			opts.SkipInitial = config.Viper.GetBool("watch-skip-initial")
+			opts.Manifest.SkipMetadata = config.Viper.GetBool("watch-skip-metadata")
+
+			return builder.New(config).Watch(cmd.Context(), opts)
+		},
+	}
+
+	defaults := builder.NewWatchOptions()
+
+	var pflags = cmd.PersistentFlags()
+	pflags.Duration("debounce", defaults.Debounce,
+		"Time without changes on a product directory before the regeneration.")
+	config.Viper.BindPFlag("watch-debounce", pflags.Lookup("debounce"))
+	pflags.Duration("poll-interval", defaults.PollInterval,
+		"Interval between two scans of the product directories when inotify is not used.")
+	config.Viper.BindPFlag("watch-poll-interval", pflags.Lookup("poll-interval"))
+	pflags.Bool("poll", false, "Poll the product directories also if inotify is available.")
+	config.Viper.BindPFlag("watch-poll", pflags.Lookup("poll"))
+	pflags.Bool("skip-initial", false,
+		"Don't regenerate the metadata of all products on start.")
+	config.Viper.BindPFlag("watch-skip-initial", pflags.Lookup("skip-initial"))
+	pflags.Bool("skip-metadata", false, "Don't read metadata.yaml of the metadata tarballs.")
+	config.Viper.BindPFlag("watch-skip-metadata", pflags.Lookup("skip-metadata"))
+
+	return cmd
+}
@@ -0,0 +1,433 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	images "github.com/MottainaiCI/simplestreams-builder/pkg/images"
+	index "github.com/MottainaiCI/simplestreams-builder/pkg/index"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+	streams "github.com/MottainaiCI/simplestreams-builder/pkg/simplestreams"
+	tools "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
+	webhook "github.com/MottainaiCI/simplestreams-builder/pkg/webhook"
+)
+
+// Builder is the entry point to build images and simplestreams
+// metadata of a tree from Go code. The functions never panic and
+// return errors of type *Error.
+type Builder struct {
+	Config *config.BuilderTreeConfig
+}
+
+type BuildProductOptions struct {
+	// Directory where the product images are created.
+	TargetDir string
+	// Directory where the product directories with the image files
+	// are available. Default is the current directory.
+	SourceDir string
+	// Name of the file used by distrobuilder. Default is image.yaml.
+	ImageFilename string
+
+	BuildLxc       bool
+	BuildLxd       bool
+	PurgeOldImages bool
+	// Time to wait after the forward of the interrupt signal to the
+	// distrobuilder and hook processes before kill them.
+	GracePeriod time.Duration
+	// Report collects the result of the build. Could be nil.
+	Report *images.BuildReport
+	// Pass arch, release and os of the product to distrobuilder as
+	// definition overrides for all products.
+	DefinitionOverrides bool
+}
+
+type BuildManifestOptions struct {
+	// Directory that contains the product directories.
+	SourceDir string
+	// Image file used to retrieve the expiry of the images.
+	ImageFile string
+	// Expire duration that overrides the image file.
+	ForceExpire string
+	// Don't read the metadata.yaml of the metadata tarballs.
+	SkipMetadata bool
+	// Fail if the metadata.yaml doesn't match with the product.
+	StrictMetadata bool
+	// Add also the versions without the required items.
+	IncludeIncomplete bool
+}
+
+type LoadManifestsOptions struct {
+	// Directory that contains the ssb.json files of the products
+	// without prefix_path.
+	SourceDir string
+	// Fail if a product is skipped.
+	Strict bool
+	// Fail if the skipped products are more than MaxSkipped.
+	// A negative value disables the check.
+	MaxSkipped int
+}
+
+func New(c *config.BuilderTreeConfig) *Builder {
+	return &Builder{Config: c}
+}
+
+func NewBuildProductOptions() BuildProductOptions {
+	return BuildProductOptions{
+		SourceDir:      ".",
+		ImageFilename:  "image.yaml",
+		BuildLxc:       true,
+		BuildLxd:       true,
+		PurgeOldImages: true,
+		GracePeriod:    10 * time.Second,
+	}
+}
+
+// Product returns the product with the name in input.
+func (b *Builder) Product(name string) (*config.SimpleStreamsProduct, error) {
+	if name == "" {
+		return nil, NewInvalidOptionsError("Missing product name.")
+	}
+
+	for idx := range b.Config.Products {
+		if b.Config.Products[idx].Name == name {
+			return &b.Config.Products[idx], nil
+		}
+	}
+
+	return nil, &Error{
+		Kind:    ErrProductNotFound,
+		Product: name,
+		Err:     fmt.Errorf("No product found with name %s", name),
+	}
+}
+
+// ProductImageFile returns the path of the distrobuilder file of the
+// product. The file is searched under the product directory and then
+// under the source directory. If the file is not available, the
+// template of the file (with suffix .tmpl) is searched too.
+func (b *Builder) ProductImageFile(product *config.SimpleStreamsProduct, sourceDir, filename string) (string, error) {
+	if sourceDir == "" {
+		sourceDir = "."
+	}
+	if filename == "" {
+		filename = "image.yaml"
+	}
+
+	imageFile := images.FindDefinitionFile(sourceDir, product.Directory, filename)
+	if imageFile != "" {
+		if path.Dir(imageFile) != strings.TrimRight(path.Join(sourceDir, product.Directory), "/") {
+			logger.Warningf(
+				"For product %s no %s file found on path %s. Using %s.",
+				product.Name, filename, path.Join(sourceDir, product.Directory), imageFile)
+		}
+		return imageFile, nil
+	}
+
+	return "", &Error{
+		Kind:    ErrInvalidOptions,
+		Product: product.Name,
+		Err:     fmt.Errorf("No %s file found for product %s.", filename, product.Name),
+	}
+}
+
+// RenderDefinition writes the distrobuilder file of the product to out.
+// If the file is a template it's rendered with the fields of the product.
+func (b *Builder) RenderDefinition(name, sourceDir, filename string, out io.Writer) error {
+	product, err := b.Product(name)
+	if err != nil {
+		return err
+	}
+
+	imageFile, err := b.ProductImageFile(product, sourceDir, filename)
+	if err != nil {
+		return err
+	}
+
+	if !images.IsDefinitionTemplate(imageFile) {
+		logger.Infof("The image file %s of the product %s is not a template.",
+			imageFile, product.Name)
+
+		f, err := os.Open(imageFile)
+		if err != nil {
+			return newError(ErrInvalidOptions, name, err)
+		}
+		defer f.Close()
+
+		_, err = io.Copy(out, f)
+		return err
+	}
+
+	return newError(ErrInvalidOptions, name,
+		images.RenderDefinition(product, b.Config.Values, imageFile, out))
+}
+
+// BuildProduct builds a new image of the product through distrobuilder
+// and purges the old images.
+func (b *Builder) BuildProduct(ctx context.Context, name string, opts BuildProductOptions) error {
+	if opts.TargetDir == "" {
+		return NewInvalidOptionsError("Missing target-dir option")
+	}
+
+	product, err := b.Product(name)
+	if err != nil {
+		opts.Report.Done(err, false)
+		return err
+	}
+
+	imageFile, err := b.ProductImageFile(product, opts.SourceDir, opts.ImageFilename)
+	if err != nil {
+		opts.Report.Done(err, false)
+		return err
+	}
+
+	bopts := images.NewBuildProductOpts()
+	bopts.BuildLxc = opts.BuildLxc
+	bopts.BuildLxd = opts.BuildLxd
+	bopts.PurgeOldImages = opts.PurgeOldImages
+	if opts.GracePeriod > 0 {
+		bopts.GracePeriod = opts.GracePeriod
+	}
+	bopts.Report = opts.Report
+	bopts.DefinitionOverrides = opts.DefinitionOverrides
+	bopts.Values = b.Config.Values
+
+	notifier := webhook.NewNotifier(b.Config)
+	if notifier.Enabled() && bopts.Report == nil {
+		// POST: the report is used to retrieve the artifacts
+		// and the purged versions to notify.
+		bopts.Report = images.NewBuildReport(name)
+	}
+
+	err = images.BuildProduct(ctx, product, opts.TargetDir, imageFile, bopts)
+	if err != nil {
+		return newError(ErrBuildFailed, name, err)
+	}
+
+	if notifier.Enabled() {
+		notifyBuild(ctx, notifier, opts.TargetDir, bopts.Report)
+	}
+
+	return nil
+}
+
+// notifyBuild sends the events of the new version and of the
+// purged versions. The errors of the webhooks don't fail the build.
+func notifyBuild(ctx context.Context, n *webhook.Notifier, targetDir string, report *images.BuildReport) {
+	if report.VersionDir != "" {
+		p := &webhook.Payload{
+			Event:     webhook.EventProductBuilt,
+			Product:   report.Product,
+			Version:   path.Base(report.VersionDir),
+			Added:     []string{path.Base(report.VersionDir)},
+			Artifacts: []webhook.Artifact{},
+		}
+
+		for _, a := range report.Artifacts {
+			rel, err := filepath.Rel(targetDir, a.Path)
+			if err != nil {
+				rel = a.Path
+			}
+			p.Artifacts = append(p.Artifacts, webhook.Artifact{
+				Name:   a.Name,
+				Url:    n.ArtifactUrl(filepath.ToSlash(rel)),
+				Size:   a.Size,
+				Sha256: a.Sha256,
+			})
+		}
+
+		n.Notify(ctx, p)
+	}
+
+	if len(report.Purged) > 0 {
+		p := &webhook.Payload{
+			Event:   webhook.EventVersionsPurged,
+			Product: report.Product,
+			Removed: []string{},
+		}
+		for _, dir := range report.Purged {
+			p.Removed = append(p.Removed, path.Base(dir))
+		}
+
+		n.Notify(ctx, p)
+	}
+}
+
+// BuildManifest creates the ssb.json manifest of the product.
+func (b *Builder) BuildManifest(ctx context.Context, name string, opts BuildManifestOptions) (*images.VersionsSSBuilderManifest, error) {
+	if opts.SourceDir == "" {
+		return nil, NewInvalidOptionsError("Missing source-dir option.")
+	}
+
+	product, err := b.Product(name)
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := images.NewItemTypeRegistryFromConfig(b.Config)
+	if err != nil {
+		return nil, newError(ErrInvalidOptions, name, err)
+	}
+
+	if opts.ForceExpire != "" {
+		if _, err = tools.ParseExpiry(opts.ForceExpire); err != nil {
+			return nil, newError(ErrInvalidOptions, name, err)
+		}
+	}
+
+	if err = ctx.Err(); err != nil {
+		return nil, newError(ErrBuildFailed, name, err)
+	}
+
+	manifest, err := images.BuildVersionsManifest(product, images.BuildVersionsManifestOptions{
+		ProductDir:          fmt.Sprintf("%s/%s", opts.SourceDir, product.Directory),
+		PrefixPath:          b.Config.Prefix,
+		ImageFile:           opts.ImageFile,
+		ForceExpireDuration: opts.ForceExpire,
+		Values:              b.Config.Values,
+		SkipMetadata:        opts.SkipMetadata,
+		StrictMetadata:      opts.StrictMetadata,
+		IncludeIncomplete:   opts.IncludeIncomplete,
+		ItemTypes:           registry,
+	})
+	if err != nil {
+		return nil, newError(ErrBuildFailed, name, err)
+	}
+
+	return manifest, nil
+}
+
+// LoadManifests retrieves the manifests of all visible products. If the
+// skipped products are not accepted by the options, the snapshot is
+// returned together with an error of kind ErrManifestInvalid.
+func (b *Builder) LoadManifests(ctx context.Context, opts LoadManifestsOptions) (*images.ManifestsSnapshot, error) {
+	snapshot, err := images.NewManifestLoader(b.Config, opts.SourceDir).Load(ctx)
+	if err != nil {
+		return nil, newError(ErrInvalidOptions, "", err)
+	}
+
+	err = snapshot.CheckSkipped(opts.Strict, opts.MaxSkipped)
+	if err != nil {
+		return snapshot, newError(ErrManifestInvalid, "", err)
+	}
+
+	return snapshot, nil
+}
+
+// BuildImages creates the images.json struct. If the snapshot is nil
+// the manifests are loaded without skip checks.
+func (b *Builder) BuildImages(ctx context.Context, snapshot *images.ManifestsSnapshot, sourceDir string) (*streams.Products, error) {
+	var err error
+
+	if snapshot == nil {
+		snapshot, err = b.LoadManifests(ctx, LoadManifestsOptions{
+			SourceDir: sourceDir, MaxSkipped: -1,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ans, err := images.BuildImagesFileFromSnapshot(b.Config, snapshot)
+	if err != nil {
+		return nil, newError(ErrBuildFailed, "", err)
+	}
+
+	return ans, nil
+}
+
+// BuildIndex creates the index.json struct. If the snapshot is nil
+// the manifests are loaded without skip checks.
+func (b *Builder) BuildIndex(ctx context.Context, snapshot *images.ManifestsSnapshot, sourceDir string) (*streams.Stream, error) {
+	var err error
+
+	if snapshot == nil {
+		snapshot, err = b.LoadManifests(ctx, LoadManifestsOptions{
+			SourceDir: sourceDir, MaxSkipped: -1,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ans, err := index.BuildIndexStructFromSnapshot(b.Config, snapshot)
+	if err != nil {
+		return nil, newError(ErrBuildFailed, "", err)
+	}
+
+	return ans, nil
+}
+
+// Metrics elaborates the metrics of the published tree. If the snapshot
+// is nil the manifests are loaded without skip checks.
+func (b *Builder) Metrics(ctx context.Context, snapshot *images.ManifestsSnapshot, sourceDir string) (*images.TreeMetrics, error) {
+	var err error
+
+	if snapshot == nil {
+		snapshot, err = b.LoadManifests(ctx, LoadManifestsOptions{
+			SourceDir: sourceDir, MaxSkipped: -1,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return images.BuildTreeMetrics(snapshot), nil
+}
+
+// NotifyImagesChanges sends to the webhooks an event for every product
+// with versions added or removed between the two images.json structs.
+// If the previous images.json is not available, for example on the first
+// publish, nothing is sent. The errors of the webhooks are only logged.
+func (b *Builder) NotifyImagesChanges(ctx context.Context, oldImgs, newImgs *streams.Products) {
+	notifier := webhook.NewNotifier(b.Config)
+	if !notifier.Enabled() {
+		return
+	}
+	if oldImgs == nil {
+		logger.Debugf("Previous images.json not available. Webhooks not notified.")
+		return
+	}
+
+	for _, d := range images.DiffProductsVersions(oldImgs, newImgs) {
+		p := &webhook.Payload{
+			Event:     webhook.EventImagesUpdated,
+			Product:   d.Name,
+			Added:     d.Added,
+			Removed:   d.Removed,
+			Artifacts: []webhook.Artifact{},
+		}
+
+		if len(d.Added) > 0 {
+			// POST: versions are sorted. The last is the newest.
+			p.Version = d.Added[len(d.Added)-1]
+
+			product := newImgs.Products[d.Name]
+			for _, v := range d.Added {
+				for name, item := range product.Versions[v].Items {
+					p.Artifacts = append(p.Artifacts, webhook.Artifact{
+						Name:   fmt.Sprintf("%s/%s", v, name),
+						Url:    notifier.ArtifactUrl(item.Path),
+						Size:   item.Size,
+						Sha256: item.HashSha256,
+					})
+				}
+			}
+			sort.Slice(p.Artifacts, func(i, j int) bool {
+				return p.Artifacts[i].Name < p.Artifacts[j].Name
+			})
+		}
+
+		notifier.Notify(ctx, p)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package builder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	streams "github.com/MottainaiCI/simplestreams-builder/pkg/simplestreams"
+)
+
+func TestNotifyImagesChanges(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+
+	c := config.NewBuilderTreeConfig(nil)
+	c.Webhooks = []config.WebhookConfig{{Name: "test", Url: srv.URL}}
+	b := New(c)
+
+	newImgs := &streams.Products{
+		Products: map[string]streams.Product{
+			"alpine": {
+				Versions: map[string]streams.ProductVersion{
+					"20231010_10:10": {Items: map[string]streams.ProductVersionItem{}},
+				},
+			},
+		},
+	}
+
+	// Without the previous images.json nothing is sent.
+	b.NotifyImagesChanges(context.Background(), nil, newImgs)
+	if calls != 0 {
+		t.Errorf("Expected no requests without the previous images.json, got %d", calls)
+	}
+
+	oldImgs := &streams.Products{Products: map[string]streams.Product{}}
+	b.NotifyImagesChanges(context.Background(), oldImgs, newImgs)
+	if calls != 1 {
+		t.Errorf("Expected 1 request, got %d", calls)
+	}
+}
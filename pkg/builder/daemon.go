@@ -0,0 +1,503 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package builder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+	tools "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
+)
+
+// Policies of the daemon for the runs missed while the daemon was
+// stopped or busy.
+const (
+	// A missed run is executed one time as soon as possible.
+	MissedRunsRunOnce = "run-once"
+	// The missed runs are only recorded on the history.
+	MissedRunsSkip = "skip"
+)
+
+// Status of the runs on the history of the daemon.
+const (
+	RunStatusSuccess     = "success"
+	RunStatusFailed      = "failed"
+	RunStatusInterrupted = "interrupted"
+	// The run is missed and skipped by the policy.
+	RunStatusMissed = "missed"
+	// The previous run of the product is not completed.
+	RunStatusSkipped = "skipped"
+)
+
+// Triggers of the runs on the history of the daemon.
+const (
+	RunTriggerSchedule = "schedule"
+	RunTriggerMissed   = "missed"
+)
+
+// A run is missed if it starts later than the tolerance.
+const daemonMissedTolerance = time.Minute
+
+type DaemonOptions struct {
+	// Options of the builds. The target directory is used also for
+	// the metadata files.
+	Build BuildProductOptions
+	// Options used to build the ssb.json files.
+	Manifest BuildManifestOptions
+	// Max number of builds running at the same time.
+	MaxConcurrent int
+	// Policy of the missed runs: run-once or skip.
+	MissedRuns string
+	// File where the history of the runs is written.
+	HistoryFile string
+	// Number of runs of a product kept on the history.
+	HistorySize int
+	// Every value received reloads the configuration with
+	// LoadConfig. The running builds are not stopped.
+	Reload     <-chan struct{}
+	LoadConfig func() (*config.BuilderTreeConfig, error)
+}
+
+// DaemonRun is a run of the daemon recorded on the history.
+type DaemonRun struct {
+	Product   string     `json:"product"`
+	Trigger   string     `json:"trigger"`
+	Scheduled time.Time  `json:"scheduled"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func NewDaemonOptions() DaemonOptions {
+	return DaemonOptions{
+		Build:         NewBuildProductOptions(),
+		MaxConcurrent: 1,
+		MissedRuns:    MissedRunsRunOnce,
+		HistorySize:   100,
+	}
+}
+
+type scheduledProduct struct {
+	name     string
+	schedule *tools.CronSchedule
+	next     time.Time
+}
+
+type daemon struct {
+	opts    DaemonOptions
+	b       *Builder
+	history *runHistory
+	sem     chan struct{}
+	wg      sync.WaitGroup
+
+	// Products scheduled. Used only by the main loop.
+	products map[string]*scheduledProduct
+
+	// Protects running and b.
+	mutex sync.Mutex
+	// Products with a run queued or running.
+	running map[string]bool
+	// Only one update of the metadata at a time.
+	metadataMutex sync.Mutex
+}
+
+// Daemon builds the products with a schedule at the times of the cron
+// expressions. The builds run at most MaxConcurrent at a time and after
+// a successful build the metadata of the tree are updated. The runs are
+// recorded on the history file, used also to find the runs missed while
+// the daemon was stopped. Daemon returns when the context is done, after
+// the end of the running builds.
+func (b *Builder) Daemon(ctx context.Context, opts DaemonOptions) error {
+	if opts.Build.TargetDir == "" {
+		return NewInvalidOptionsError("Missing target-dir option.")
+	}
+	if opts.HistoryFile == "" {
+		return NewInvalidOptionsError("Missing history file.")
+	}
+	if opts.MaxConcurrent <= 0 {
+		return NewInvalidOptionsError("Invalid max concurrent builds %d.", opts.MaxConcurrent)
+	}
+	switch opts.MissedRuns {
+	case MissedRunsRunOnce, MissedRunsSkip:
+	default:
+		return NewInvalidOptionsError("Invalid missed runs policy %q. Use run-once or skip.",
+			opts.MissedRuns)
+	}
+	// The report is not shared between the builds.
+	opts.Build.Report = nil
+
+	history, err := loadRunHistory(opts.HistoryFile, opts.HistorySize)
+	if err != nil {
+		return NewInvalidOptionsError("Error on read history file %s: %s",
+			opts.HistoryFile, err.Error())
+	}
+
+	d := &daemon{
+		opts:     opts,
+		b:        b,
+		history:  history,
+		sem:      make(chan struct{}, opts.MaxConcurrent),
+		products: map[string]*scheduledProduct{},
+		running:  map[string]bool{},
+	}
+	d.setProducts(b.Config, time.Now())
+
+	return d.loop(ctx)
+}
+
+func (d *daemon) loop(ctx context.Context) error {
+	for {
+		now := time.Now()
+		// The clock could change, so the schedules are checked
+		// at least every minute.
+		wait := time.Minute
+		for _, p := range d.products {
+			if until := p.next.Sub(now); until < wait {
+				wait = until
+			}
+		}
+		if wait < 0 {
+			wait = 0
+		}
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logger.Infof("Daemon stopped. Waiting for the running builds.")
+			d.wg.Wait()
+			return nil
+
+		case _, ok := <-d.opts.Reload:
+			timer.Stop()
+			if !ok {
+				d.opts.Reload = nil
+				continue
+			}
+			d.reload()
+
+		case <-timer.C:
+			d.startDue(ctx, time.Now())
+		}
+	}
+}
+
+// setProducts updates the products scheduled with the configuration. The
+// products with the same schedule keep the next run.
+func (d *daemon) setProducts(c *config.BuilderTreeConfig, now time.Time) {
+	products := map[string]*scheduledProduct{}
+
+	for idx := range c.Products {
+		p := &c.Products[idx]
+		if p.Schedule == "" {
+			continue
+		}
+		if p.PrefixPath != "" {
+			logger.Warningf("Product %s with prefix_path can't be scheduled.", p.Name)
+			continue
+		}
+
+		if old, ok := d.products[p.Name]; ok && old.schedule.Expr == p.Schedule {
+			products[p.Name] = old
+			continue
+		}
+
+		schedule, err := tools.ParseCron(p.Schedule)
+		if err != nil {
+			logger.Errorf("Product %s not scheduled: %s", p.Name, err.Error())
+			continue
+		}
+
+		sp := &scheduledProduct{name: p.Name, schedule: schedule}
+		// The runs after the last run on the history are missed.
+		if last, ok := d.history.LastScheduled(p.Name); ok {
+			sp.next = schedule.Next(last)
+		} else {
+			sp.next = schedule.Next(now)
+		}
+		products[p.Name] = sp
+		logger.Infof("Product %s scheduled at %s, next run %s.", p.Name,
+			p.Schedule, sp.next.Format(time.RFC3339))
+	}
+
+	d.products = products
+	logger.Infof("%d products scheduled.", len(products))
+}
+
+func (d *daemon) reload() {
+	logger.Infof("Reloading the configuration.")
+
+	if d.opts.LoadConfig == nil {
+		logger.Warningf("Reload of the configuration not supported.")
+		return
+	}
+
+	c, err := d.opts.LoadConfig()
+	if err != nil {
+		logger.Errorf("Error on reload the configuration, the current is kept: %s", err.Error())
+		return
+	}
+
+	// POST: the running builds use the previous configuration for
+	// the build and the current one for the metadata.
+	d.mutex.Lock()
+	d.b = New(c)
+	d.mutex.Unlock()
+	d.setProducts(c, time.Now())
+}
+
+// startDue starts the runs with the scheduled time passed.
+func (d *daemon) startDue(ctx context.Context, now time.Time) {
+	names := []string{}
+	for name, p := range d.products {
+		if !p.next.IsZero() && !p.next.After(now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := d.products[name]
+		scheduled := p.next
+		trigger := RunTriggerSchedule
+		p.next = p.schedule.Next(now)
+
+		if now.Sub(scheduled) > daemonMissedTolerance {
+			if d.opts.MissedRuns == MissedRunsSkip {
+				logger.Warningf("Skipping missed run of product %s scheduled at %s.",
+					name, scheduled.Format(time.RFC3339))
+				d.record(DaemonRun{
+					Product: name, Trigger: RunTriggerMissed,
+					Scheduled: scheduled, Status: RunStatusMissed,
+				})
+				continue
+			}
+			trigger = RunTriggerMissed
+		}
+
+		d.start(ctx, name, trigger, scheduled)
+	}
+}
+
+func (d *daemon) start(ctx context.Context, name, trigger string, scheduled time.Time) {
+	d.mutex.Lock()
+	busy := d.running[name]
+	if !busy {
+		d.running[name] = true
+	}
+	d.mutex.Unlock()
+
+	if busy {
+		logger.Warningf("Skipping run of product %s scheduled at %s: the previous run is not completed.",
+			name, scheduled.Format(time.RFC3339))
+		d.record(DaemonRun{
+			Product: name, Trigger: trigger,
+			Scheduled: scheduled, Status: RunStatusSkipped,
+		})
+		return
+	}
+
+	d.wg.Add(1)
+	go d.run(ctx, d.builder(), name, trigger, scheduled)
+}
+
+func (d *daemon) run(ctx context.Context, b *Builder, name, trigger string, scheduled time.Time) {
+	defer d.wg.Done()
+	defer func() {
+		d.mutex.Lock()
+		delete(d.running, name)
+		d.mutex.Unlock()
+	}()
+
+	r := DaemonRun{Product: name, Trigger: trigger, Scheduled: scheduled}
+
+	select {
+	case d.sem <- struct{}{}:
+	case <-ctx.Done():
+		r.Status = RunStatusInterrupted
+		d.record(r)
+		return
+	}
+	defer func() { <-d.sem }()
+
+	started := time.Now()
+	r.Started = &started
+	logger.Infof("Starting build of product %s (%s).", name, trigger)
+
+	err := b.BuildProduct(ctx, name, d.opts.Build)
+	if err == nil {
+		err = d.updateMetadata(ctx, name)
+	}
+
+	finished := time.Now()
+	r.Finished = &finished
+	switch {
+	case err == nil:
+		r.Status = RunStatusSuccess
+		logger.Infof("Build of product %s completed in %s.", name,
+			finished.Sub(started).Round(time.Second))
+	case ctx.Err() != nil || errors.Is(err, context.Canceled):
+		r.Status = RunStatusInterrupted
+		r.Error = err.Error()
+		logger.Warningf("Build of product %s interrupted.", name)
+	default:
+		r.Status = RunStatusFailed
+		r.Error = err.Error()
+		logger.Errorf("Build of product %s failed: %s", name, err.Error())
+	}
+
+	d.record(r)
+}
+
+// updateMetadata updates the metadata after the build of the product.
+// The builder of the current configuration is used, because the
+// configuration could be reloaded during the build.
+func (d *daemon) updateMetadata(ctx context.Context, name string) error {
+	d.metadataMutex.Lock()
+	defer d.metadataMutex.Unlock()
+
+	b := d.builder()
+	products := []*config.SimpleStreamsProduct{}
+	if product, err := b.Product(name); err == nil {
+		products = append(products, product)
+	} else {
+		logger.Warningf("Product %s removed from the configuration, ssb.json not updated.", name)
+	}
+
+	return b.updateMetadata(ctx, d.opts.Build.TargetDir, d.opts.Manifest, products)
+}
+
+// builder returns the builder of the current configuration.
+func (d *daemon) builder() *Builder {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.b
+}
+
+func (d *daemon) record(r DaemonRun) {
+	err := d.history.Add(r)
+	if err != nil {
+		logger.Errorf("Error on write history file %s: %s", d.history.file, err.Error())
+	}
+}
+
+// runHistory contains the last runs of the products and it's written
+// on file in JSON lines format.
+type runHistory struct {
+	mutex sync.Mutex
+	file  string
+	size  int
+	runs  []DaemonRun
+}
+
+// ReadDaemonHistory reads the history file of the daemon. The lines
+// not valid are ignored.
+func ReadDaemonHistory(file string) ([]DaemonRun, error) {
+	ans := []DaemonRun{}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ans, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r DaemonRun
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			logger.Warningf("Ignoring line %d of history file %s: %s", n, file, err.Error())
+			continue
+		}
+		ans = append(ans, r)
+	}
+
+	return ans, scanner.Err()
+}
+
+func loadRunHistory(file string, size int) (*runHistory, error) {
+	runs, err := ReadDaemonHistory(file)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &runHistory{file: file, size: size, runs: runs}
+	h.trim()
+
+	return h, nil
+}
+
+// trim removes the oldest runs of the products with more than size runs.
+func (h *runHistory) trim() {
+	if h.size <= 0 {
+		return
+	}
+
+	count := map[string]int{}
+	for _, r := range h.runs {
+		count[r.Product]++
+	}
+
+	runs := []DaemonRun{}
+	for _, r := range h.runs {
+		if count[r.Product] > h.size {
+			count[r.Product]--
+			continue
+		}
+		runs = append(runs, r)
+	}
+	h.runs = runs
+}
+
+// LastScheduled returns the scheduled time of the last run of the product.
+func (h *runHistory) LastScheduled(product string) (time.Time, bool) {
+	var ans time.Time
+	var found bool
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, r := range h.runs {
+		if r.Product == product && (!found || r.Scheduled.After(ans)) {
+			ans = r.Scheduled
+			found = true
+		}
+	}
+
+	return ans, found
+}
+
+// Add adds the run and writes the history file.
+func (h *runHistory) Add(r DaemonRun) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.runs = append(h.runs, r)
+	h.trim()
+
+	return writeFileAtomic(h.file, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, r := range h.runs {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,73 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package builder
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidOptions is returned when the options or the configuration
+	// are not valid.
+	ErrInvalidOptions = errors.New("invalid options")
+	// ErrProductNotFound is returned when the product is not defined
+	// on the tree configuration.
+	ErrProductNotFound = errors.New("product not found")
+	// ErrManifestInvalid is returned when a manifest is not valid or
+	// when the products skipped are not accepted.
+	ErrManifestInvalid = errors.New("manifest invalid")
+	// ErrBuildFailed is returned when the build of an image or of a
+	// metadata file fails.
+	ErrBuildFailed = errors.New("build failed")
+)
+
+// Error is the error returned by the builder functions. The Kind
+// is one of the Err* variables and it could be checked with errors.Is.
+type Error struct {
+	Kind    error
+	Product string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	var msg string
+	if e.Err != nil {
+		msg = e.Err.Error()
+	} else {
+		msg = e.Kind.Error()
+	}
+
+	if e.Product != "" {
+		return fmt.Sprintf("%s: product %s: %s", e.Kind.Error(), e.Product, msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind.Error(), msg)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func newError(kind error, product string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// Avoid to wrap an error already processed.
+	var berr *Error
+	if errors.As(err, &berr) {
+		return err
+	}
+
+	return &Error{Kind: kind, Product: product, Err: err}
+}
+
+// NewInvalidOptionsError returns an error with kind ErrInvalidOptions.
+func NewInvalidOptionsError(format string, args ...interface{}) error {
+	return &Error{Kind: ErrInvalidOptions, Err: fmt.Errorf(format, args...)}
+}
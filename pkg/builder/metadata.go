@@ -0,0 +1,136 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package builder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	images "github.com/MottainaiCI/simplestreams-builder/pkg/images"
+	index "github.com/MottainaiCI/simplestreams-builder/pkg/index"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+)
+
+// updateMetadata writes the ssb.json of the products in input under the
+// target directory and then images.json and index.json. The products
+// without directory are ignored. If the ssb.json of a product fails
+// the other files are updated anyway.
+func (b *Builder) updateMetadata(ctx context.Context, targetDir string,
+	mopts BuildManifestOptions, products []*config.SimpleStreamsProduct) error {
+	failed := []string{}
+	mopts.SourceDir = targetDir
+
+	for _, p := range products {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		dir := filepath.Join(targetDir, p.Directory)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			logger.Debugf("Directory %s of product %s not available.", dir, p.Name)
+			continue
+		}
+
+		manifest, err := b.BuildManifest(ctx, p.Name, mopts)
+		if err == nil {
+			err = writeFileAtomic(filepath.Join(dir, "ssb.json"), func(w io.Writer) error {
+				return images.WriteVersionsManifestJson(manifest, w)
+			})
+		}
+		if err != nil {
+			logger.Errorf("Error on update ssb.json of product %s: %s", p.Name, err.Error())
+			failed = append(failed, p.Name)
+			continue
+		}
+		logger.Infof("Updated ssb.json of product %s.", p.Name)
+	}
+
+	snapshot, err := b.LoadManifests(ctx, LoadManifestsOptions{
+		SourceDir: targetDir, MaxSkipped: -1,
+	})
+	if err != nil {
+		return fmt.Errorf("Error on load manifests: %s", err.Error())
+	}
+
+	imgs, err := b.BuildImages(ctx, snapshot, targetDir)
+	if err != nil {
+		return fmt.Errorf("Error on build images.json: %s", err.Error())
+	}
+
+	streamsDir := filepath.Join(targetDir, "streams", "v1")
+	oldImgs, _ := images.ReadImagesJson(filepath.Join(streamsDir, "images.json"))
+
+	err = writeFileAtomic(filepath.Join(streamsDir, "images.json"), func(w io.Writer) error {
+		return images.WriteImagesJson(imgs, w)
+	})
+	if err != nil {
+		return fmt.Errorf("Error on write images.json: %s", err.Error())
+	}
+
+	b.NotifyImagesChanges(ctx, oldImgs, imgs)
+
+	idx, err := b.BuildIndex(ctx, snapshot, targetDir)
+	if err != nil {
+		return fmt.Errorf("Error on build index.json: %s", err.Error())
+	}
+
+	err = writeFileAtomic(filepath.Join(streamsDir, "index.json"), func(w io.Writer) error {
+		return index.WriteIndexJson(idx, w)
+	})
+	if err != nil {
+		return fmt.Errorf("Error on write index.json: %s", err.Error())
+	}
+
+	logger.Infof("Updated images.json and index.json.")
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Error on update ssb.json of products %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes the file through a temporary file renamed at
+// the end, so the clients never read a partial file.
+func writeFileAtomic(file string, writer func(io.Writer) error) error {
+	dir := filepath.Dir(file)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err = os.MkdirAll(dir, 0760)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	err = writer(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,309 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+)
+
+type WatchOptions struct {
+	// Directory that contains the product directories. The metadata
+	// files are written under the same directory.
+	TargetDir string
+	// Time without changes on the product directory before the
+	// regeneration of the metadata.
+	Debounce time.Duration
+	// Interval between two scans of the product directories when
+	// inotify is not used.
+	PollInterval time.Duration
+	// Use the polling also if inotify is available.
+	Poll bool
+	// Don't regenerate the metadata of all products on start.
+	SkipInitial bool
+	// Options used to build the ssb.json files. SourceDir is
+	// replaced with TargetDir.
+	Manifest BuildManifestOptions
+}
+
+func NewWatchOptions() WatchOptions {
+	return WatchOptions{
+		Debounce:     30 * time.Second,
+		PollInterval: 10 * time.Second,
+	}
+}
+
+// watchedProduct contains the state of a product directory.
+type watchedProduct struct {
+	product *config.SimpleStreamsProduct
+	dir     string
+	// Signature of the version directories used by the polling.
+	signature string
+	// The directory is watched by inotify.
+	watched bool
+	// The directory is polled because inotify is not usable.
+	polled     bool
+	dirty      bool
+	lastChange time.Time
+}
+
+// Watch monitors the directories of the local products under the target
+// directory and, when the version directories don't change for the
+// debounce time, regenerates the ssb.json of the changed products and
+// then images.json and index.json. The incomplete versions are skipped
+// by the manifests until all the items are available.
+// inotify is used when available, otherwise the directories are polled.
+// Watch returns when the context is done.
+func (b *Builder) Watch(ctx context.Context, opts WatchOptions) error {
+	var watcher *fsnotify.Watcher
+	var events chan fsnotify.Event
+	var errs chan error
+	var err error
+
+	if opts.TargetDir == "" {
+		return NewInvalidOptionsError("Missing target-dir option.")
+	}
+	if opts.Debounce <= 0 || opts.PollInterval <= 0 {
+		return NewInvalidOptionsError("Invalid debounce or poll interval.")
+	}
+	opts.Manifest.SourceDir = opts.TargetDir
+
+	products := []*watchedProduct{}
+	for idx := range b.Config.Products {
+		p := &b.Config.Products[idx]
+		if p.PrefixPath != "" {
+			continue
+		}
+		dir := filepath.Clean(filepath.Join(opts.TargetDir, p.Directory))
+		products = append(products, &watchedProduct{
+			product:   p,
+			dir:       dir,
+			signature: versionsSignature(dir),
+			dirty:     !opts.SkipInitial,
+		})
+	}
+	if len(products) == 0 {
+		return NewInvalidOptionsError("No local products to watch.")
+	}
+
+	if !opts.Poll {
+		watcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			logger.Warningf("inotify not available, using polling: %s", err.Error())
+		} else {
+			defer watcher.Close()
+			events = watcher.Events
+			errs = watcher.Errors
+			for _, wp := range products {
+				watchProductDir(watcher, wp)
+			}
+		}
+	}
+
+	logger.Infof("Watching %d products under %s.", len(products), opts.TargetDir)
+
+	tick := time.Second
+	if opts.Debounce < 4*tick {
+		tick = opts.Debounce / 4
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	lastPoll := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Infof("Watch stopped.")
+			return nil
+
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			wp, isProductDir := findWatchedProduct(products, ev.Name)
+			if wp == nil {
+				continue
+			}
+			logger.Debugf("Event %s on %s.", ev.Op.String(), ev.Name)
+			if isProductDir && ev.Op&fsnotify.Create != 0 {
+				// New version directory.
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() && !wp.polled {
+					if err := watcher.Add(ev.Name); err != nil {
+						logger.Warningf("Error on watch %s, using polling for product %s: %s",
+							ev.Name, wp.product.Name, err.Error())
+						wp.polled = true
+					}
+				}
+			}
+			wp.dirty = true
+			wp.lastChange = time.Now()
+
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			logger.Warningf("Error on watch: %s", err.Error())
+
+		case now := <-ticker.C:
+			if now.Sub(lastPoll) >= opts.PollInterval {
+				lastPoll = now
+				for _, wp := range products {
+					if watcher != nil && !wp.watched && !wp.polled {
+						// The product directory could be created later.
+						if !watchProductDir(watcher, wp) {
+							continue
+						}
+					} else if watcher != nil && !wp.polled {
+						continue
+					}
+					sign := versionsSignature(wp.dir)
+					if sign != wp.signature {
+						wp.signature = sign
+						wp.dirty = true
+						wp.lastChange = now
+					}
+				}
+			}
+
+			ready := []*watchedProduct{}
+			for _, wp := range products {
+				if wp.dirty && now.Sub(wp.lastChange) >= opts.Debounce {
+					wp.dirty = false
+					ready = append(ready, wp)
+				}
+			}
+			if len(ready) > 0 {
+				b.regenerateMetadata(ctx, opts, ready)
+			}
+		}
+	}
+}
+
+// watchProductDir adds the product directory and the version
+// directories to the watcher. It returns false if the product
+// directory is not available yet. If the directories can't be
+// watched, for example for the limit of inotify watches, the
+// product is polled.
+func watchProductDir(watcher *fsnotify.Watcher, wp *watchedProduct) bool {
+	dirs := []string{wp.dir}
+	for _, v := range versionDirs(wp.dir) {
+		dirs = append(dirs, filepath.Join(wp.dir, v))
+	}
+
+	for idx, dir := range dirs {
+		err := watcher.Add(dir)
+		if err == nil {
+			continue
+		}
+		if idx == 0 && os.IsNotExist(err) {
+			return false
+		}
+		if os.IsNotExist(err) {
+			// The version directory is just removed.
+			continue
+		}
+
+		logger.Warningf("Error on watch %s, using polling for product %s: %s",
+			dir, wp.product.Name, err.Error())
+		wp.polled = true
+		return true
+	}
+	wp.watched = true
+
+	return true
+}
+
+// findWatchedProduct returns the product of the path of an event and
+// if the path is a version directory. The hidden files, used by rsync
+// for the partial transfers, and the ssb.json file are ignored.
+func findWatchedProduct(products []*watchedProduct, file string) (*watchedProduct, bool) {
+	name := filepath.Base(file)
+	if strings.HasPrefix(name, ".") {
+		return nil, false
+	}
+
+	dir := filepath.Dir(file)
+	for _, wp := range products {
+		if dir == wp.dir {
+			if name == "ssb.json" {
+				return nil, false
+			}
+			return wp, true
+		}
+		if filepath.Dir(dir) == wp.dir {
+			return wp, false
+		}
+	}
+
+	return nil, false
+}
+
+func versionDirs(dir string) []string {
+	ans := []string{}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ans
+	}
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			ans = append(ans, f.Name())
+		}
+	}
+
+	return ans
+}
+
+// versionsSignature returns a string with name, size and modification
+// time of the files of the version directories.
+func versionsSignature(dir string) string {
+	entries := []string{}
+
+	for _, v := range versionDirs(dir) {
+		files, err := ioutil.ReadDir(filepath.Join(dir, v))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			entries = append(entries, fmt.Sprintf("%s/%s:%d:%d",
+				v, f.Name(), f.Size(), f.ModTime().UnixNano()))
+		}
+		entries = append(entries, v+"/")
+	}
+	sort.Strings(entries)
+
+	return strings.Join(entries, "\n")
+}
+
+// regenerateMetadata updates the metadata of the products in input.
+// The errors are only logged so the watch is not stopped.
+func (b *Builder) regenerateMetadata(ctx context.Context, opts WatchOptions, products []*watchedProduct) {
+	list := []*config.SimpleStreamsProduct{}
+	for _, wp := range products {
+		// Update the signature with the content used by the manifest.
+		wp.signature = versionsSignature(wp.dir)
+		list = append(list, wp.product)
+	}
+
+	err := b.updateMetadata(ctx, opts.TargetDir, opts.Manifest, list)
+	if err != nil && ctx.Err() == nil {
+		logger.Error(err)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var aliasPlaceholderRegex = regexp.MustCompile(`\{\{\s*([a-z_]*)\s*\}\}`)
+
+// aliasFields contains the placeholders supported by the alias templates.
+var aliasFields = map[string]func(p *SimpleStreamsProduct) string{
+	"os":      func(p *SimpleStreamsProduct) string { return p.OperatingSystem },
+	"release": func(p *SimpleStreamsProduct) string { return p.Release },
+	"variant": func(p *SimpleStreamsProduct) string { return p.Variant },
+	"arch":    func(p *SimpleStreamsProduct) string { return p.Architecture },
+}
+
+// CheckAliasTemplate returns an error if the template contains
+// unknown placeholders.
+func CheckAliasTemplate(tmpl string) error {
+	if strings.TrimSpace(tmpl) == "" {
+		return fmt.Errorf("Empty alias template")
+	}
+
+	for _, m := range aliasPlaceholderRegex.FindAllStringSubmatch(tmpl, -1) {
+		if _, ok := aliasFields[m[1]]; !ok {
+			return fmt.Errorf("Invalid placeholder {{%s}} on alias template %q. Use os, release, variant or arch",
+				m[1], tmpl)
+		}
+	}
+
+	return nil
+}
+
+// ExpandAliasTemplate returns the alias of the product from the
+// template. The templates without {{variant}} are used only by the
+// default variant or by the products without variant, so the same
+// alias is not generated for all the variants. An empty string is
+// returned if the template is not applicable.
+func ExpandAliasTemplate(tmpl string, p *SimpleStreamsProduct) string {
+	var empty bool
+
+	if !aliasPlaceholderRegex.MatchString(tmpl) {
+		return tmpl
+	}
+
+	hasVariant := false
+	ans := aliasPlaceholderRegex.ReplaceAllStringFunc(tmpl, func(s string) string {
+		name := aliasPlaceholderRegex.FindStringSubmatch(s)[1]
+		if name == "variant" {
+			hasVariant = true
+		}
+		f, ok := aliasFields[name]
+		if !ok {
+			empty = true
+			return s
+		}
+		value := f(p)
+		if value == "" {
+			empty = true
+		}
+		return strings.ToLower(strings.ReplaceAll(value, " ", "-"))
+	})
+
+	if empty || (!hasVariant && p.Variant != "" && !p.Default) {
+		return ""
+	}
+
+	return ans
+}
+
+// ProductAliases returns the aliases of the product: the aliases
+// defined on the product and the aliases generated by the alias
+// templates of the product or, if not defined, of the tree.
+func (b *BuilderTreeConfig) ProductAliases(p *SimpleStreamsProduct) []string {
+	ans := []string{}
+	seen := map[string]bool{}
+
+	templates := p.AliasTemplates
+	if len(templates) == 0 {
+		templates = b.AliasTemplates
+	}
+
+	add := func(alias string) {
+		if alias != "" && !seen[alias] {
+			seen[alias] = true
+			ans = append(ans, alias)
+		}
+	}
+
+	for _, a := range p.Aliases {
+		add(a)
+	}
+	for _, t := range templates {
+		add(ExpandAliasTemplate(t, p))
+	}
+
+	return ans
+}
+
+// ExpandAliases writes the aliases generated by the alias templates
+// on the products and checks that an alias is not used by two
+// visible products with the same architecture.
+func (b *BuilderTreeConfig) ExpandAliases() error {
+	for idx := range b.Products {
+		b.Products[idx].Aliases = b.ProductAliases(&b.Products[idx])
+	}
+
+	conflicts := AliasConflicts(b.Products)
+	if len(conflicts) > 0 {
+		msgs := []string{}
+		for _, c := range conflicts {
+			msgs = append(msgs, c.String())
+		}
+		return fmt.Errorf("Duplicate aliases: %s", strings.Join(msgs, "; "))
+	}
+
+	return nil
+}
+
+// AliasConflict is an alias used by two visible products with the
+// same architecture.
+type AliasConflict struct {
+	Alias string
+	Arch  string
+	// Index and name of the product that uses the alias already
+	// used by the owner.
+	Index   int
+	Product string
+	Owner   string
+}
+
+func (c AliasConflict) String() string {
+	return fmt.Sprintf("alias %s (arch %s) of product %s is used also by product %s",
+		c.Alias, c.Arch, c.Product, c.Owner)
+}
+
+// AliasConflicts returns the aliases used by more visible products with
+// the same architecture. LXD resolves the aliases without architecture
+// with the architecture of the client.
+func AliasConflicts(products []SimpleStreamsProduct) []AliasConflict {
+	ans := []AliasConflict{}
+	owners := map[string]string{}
+
+	for idx, p := range products {
+		if p.Hidden {
+			continue
+		}
+		for _, a := range p.Aliases {
+			key := a + "|" + p.Architecture
+			if owner, ok := owners[key]; ok && owner != p.Name {
+				ans = append(ans, AliasConflict{
+					Alias:   a,
+					Arch:    p.Architecture,
+					Index:   idx,
+					Product: p.Name,
+					Owner:   owner,
+				})
+				continue
+			}
+			owners[key] = p.Name
+		}
+	}
+
+	return ans
+}
@@ -22,7 +22,9 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"time"
 
 	v "github.com/spf13/viper"
 )
@@ -32,28 +34,160 @@ const (
 )
 
 type SimpleStreamsProduct struct {
-	Name            string   `mapstructure:"name" json:"name" yaml:"name"`
-	Architecture    string   `mapstructure:"arch" json:"arch" yaml:"arch"`
-	Release         string   `mapstructure:"release" json:"release" yaml:"release"`
-	ReleaseTitle    string   `mapstructure:"release_title" json:"release_title" yaml:"release_title"`
-	OperatingSystem string   `mapstructure:"os" json:"os" yaml:"os"`
-	Directory       string   `mapstructure:"directory" json:"directory" yaml:"directory"`
-	Version         string   `mapstructure:"version" json:"version" yaml:"version"`
-	PrefixPath      string   `mapstructure:"prefix_path" json:"prefix_path" yaml:"prefix_path"`
-	BuildScriptHook string   `mapstructure:"build_script_hook" json:"build_script_hook,omitempty" yaml:"build_script_hook,omitempty"`
-	Aliases         []string `mapstructure:"aliases" json:"aliases" yaml:"aliases"`
-	Hidden          bool     `mapstructure:"hidden" json:"hidden,omitempty" yaml:"hidden"`
-	Days            int      `mapstructure:"days" json:"days" yaml:"days"`
+	Name            string          `mapstructure:"name" json:"name" yaml:"name"`
+	Architecture    string          `mapstructure:"arch" json:"arch" yaml:"arch"`
+	Release         string          `mapstructure:"release" json:"release" yaml:"release"`
+	ReleaseTitle    string          `mapstructure:"release_title" json:"release_title" yaml:"release_title"`
+	OperatingSystem string          `mapstructure:"os" json:"os" yaml:"os"`
+	Variant         string          `mapstructure:"variant" json:"variant,omitempty" yaml:"variant,omitempty"`
+	Directory       string          `mapstructure:"directory" json:"directory" yaml:"directory"`
+	Version         string          `mapstructure:"version" json:"version" yaml:"version"`
+	PrefixPath      string          `mapstructure:"prefix_path" json:"prefix_path" yaml:"prefix_path"`
+	BuildScriptHook string          `mapstructure:"build_script_hook" json:"build_script_hook,omitempty" yaml:"build_script_hook,omitempty"`
+	Aliases         []string        `mapstructure:"aliases" json:"aliases" yaml:"aliases"`
+	Hidden          bool            `mapstructure:"hidden" json:"hidden,omitempty" yaml:"hidden"`
+	Days            int             `mapstructure:"days" json:"days" yaml:"days"`
+	ItemTypes       []string        `mapstructure:"item_types" json:"item_types,omitempty" yaml:"item_types,omitempty"`
+	Auth            *HttpAuthConfig `mapstructure:"auth" json:"auth,omitempty" yaml:"auth,omitempty"`
+	// Absolute support EOL (YYYY-MM-DD, RFC3339 or unix timestamp).
+	SupportEOL string `mapstructure:"support_eol" json:"support_eol,omitempty" yaml:"support_eol,omitempty"`
+	// Expiry duration from the build date of the newest version.
+	Expiry string `mapstructure:"expiry" json:"expiry,omitempty" yaml:"expiry,omitempty"`
+	// Pass arch, release and os to distrobuilder as definition overrides.
+	DefinitionOverrides bool `mapstructure:"definition_overrides" json:"definition_overrides,omitempty" yaml:"definition_overrides,omitempty"`
+	// Additional definition overrides passed to distrobuilder with -o.
+	Options map[string]string `mapstructure:"options" json:"options,omitempty" yaml:"options,omitempty"`
+	// Variables available on the templates of the image file.
+	Vars map[string]interface{} `mapstructure:"vars" json:"vars,omitempty" yaml:"vars,omitempty"`
+	// Templates of the aliases generated for the product, for example
+	// {{os}}/{{release}}/{{variant}}. They override the templates of the tree.
+	AliasTemplates []string `mapstructure:"alias_templates" json:"alias_templates,omitempty" yaml:"alias_templates,omitempty"`
+	// The product is the default variant: the alias templates without
+	// {{variant}} are used.
+	Default bool `mapstructure:"default" json:"default,omitempty" yaml:"default,omitempty"`
+	// Metadata tarballs built and published: lxd-only, incus-only,
+	// bridged (default) or native-both.
+	MetadataMode string `mapstructure:"metadata_mode" json:"metadata_mode,omitempty" yaml:"metadata_mode,omitempty"`
+	// Items required to publish a version of the product.
+	Completeness *ProductCompleteness `mapstructure:"completeness" json:"completeness,omitempty" yaml:"completeness,omitempty"`
+	// Cron expression used by the daemon to build the product.
+	Schedule string `mapstructure:"schedule" json:"schedule,omitempty" yaml:"schedule,omitempty"`
+
+	// Configuration file where the product is defined.
+	Source string `mapstructure:"-" json:"-" yaml:"-"`
+}
+
+// SimpleStreamsItemType describes a custom artifact of a product version.
+type SimpleStreamsItemType struct {
+	Name         string `mapstructure:"name" json:"name" yaml:"name"`
+	Pattern      string `mapstructure:"pattern" json:"pattern" yaml:"pattern"`
+	FileType     string `mapstructure:"ftype" json:"ftype" yaml:"ftype"`
+	Kind         string `mapstructure:"kind" json:"kind" yaml:"kind"`
+	CombinedHash string `mapstructure:"combined_hash" json:"combined_hash,omitempty" yaml:"combined_hash,omitempty"`
+	Default      bool   `mapstructure:"default" json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+// ProductCompleteness contains the sets of items required to publish
+// a version as container or as virtual machine. A version is complete
+// if one of the sets defined is available.
+type ProductCompleteness struct {
+	Container []string `mapstructure:"container" json:"container,omitempty" yaml:"container,omitempty"`
+	Vm        []string `mapstructure:"vm" json:"vm,omitempty" yaml:"vm,omitempty"`
+}
+
+func (c *ProductCompleteness) String() string {
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("container: %s, vm: %s", c.Container, c.Vm)
+}
+
+// HttpClientConfig contains the settings used to fetch remote manifests.
+type HttpClientConfig struct {
+	Timeout     time.Duration `mapstructure:"timeout" json:"timeout" yaml:"timeout"`
+	Retries     int           `mapstructure:"retries" json:"retries" yaml:"retries"`
+	Backoff     time.Duration `mapstructure:"backoff" json:"backoff" yaml:"backoff"`
+	MaxBackoff  time.Duration `mapstructure:"max_backoff" json:"max_backoff" yaml:"max_backoff"`
+	Proxy       string        `mapstructure:"proxy" json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	Concurrency int           `mapstructure:"concurrency" json:"concurrency" yaml:"concurrency"`
+	CacheDir    string        `mapstructure:"cache_dir" json:"cache_dir,omitempty" yaml:"cache_dir,omitempty"`
+}
+
+// HttpAuthConfig contains the authentication and TLS settings used
+// to retrieve the manifests of a product or of an host.
+type HttpAuthConfig struct {
+	// Host is used only by the tree auth list. It could be
+	// an hostname, an host:port or a pattern like *.example.com.
+	Host string `mapstructure:"host" json:"host,omitempty" yaml:"host,omitempty"`
+	// Type could be token, bearer, basic, netrc or none.
+	Type string `mapstructure:"type" json:"type,omitempty" yaml:"type,omitempty"`
+
+	Token        string `mapstructure:"token" json:"token,omitempty" yaml:"token,omitempty"`
+	TokenFile    string `mapstructure:"token_file" json:"token_file,omitempty" yaml:"token_file,omitempty"`
+	TokenEnv     string `mapstructure:"token_env" json:"token_env,omitempty" yaml:"token_env,omitempty"`
+	Username     string `mapstructure:"username" json:"username,omitempty" yaml:"username,omitempty"`
+	Password     string `mapstructure:"password" json:"password,omitempty" yaml:"password,omitempty"`
+	PasswordFile string `mapstructure:"password_file" json:"password_file,omitempty" yaml:"password_file,omitempty"`
+	PasswordEnv  string `mapstructure:"password_env" json:"password_env,omitempty" yaml:"password_env,omitempty"`
+	NetrcFile    string `mapstructure:"netrc_file" json:"netrc_file,omitempty" yaml:"netrc_file,omitempty"`
+
+	CABundle           string `mapstructure:"ca_bundle" json:"ca_bundle,omitempty" yaml:"ca_bundle,omitempty"`
+	ClientCert         string `mapstructure:"client_cert" json:"client_cert,omitempty" yaml:"client_cert,omitempty"`
+	ClientKey          string `mapstructure:"client_key" json:"client_key,omitempty" yaml:"client_key,omitempty"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skipverify" json:"insecure_skipverify,omitempty" yaml:"insecure_skipverify,omitempty"`
+}
+
+// HasCredentials returns true if a token, an username, a password
+// or a netrc file is defined.
+func (a *HttpAuthConfig) HasCredentials() bool {
+	return a.Token != "" || a.TokenFile != "" || a.TokenEnv != "" ||
+		a.Username != "" || a.Password != "" || a.PasswordFile != "" ||
+		a.PasswordEnv != "" || a.NetrcFile != ""
+}
+
+// WebhookConfig defines an endpoint notified with a JSON payload
+// when new versions are published or removed.
+type WebhookConfig struct {
+	Name string `mapstructure:"name" json:"name" yaml:"name"`
+	Url  string `mapstructure:"url" json:"url" yaml:"url"`
+	// Events to send. If empty all events are sent.
+	Events []string `mapstructure:"events" json:"events,omitempty" yaml:"events,omitempty"`
+	// Secret used to sign the payload with HMAC-SHA256.
+	Secret     string            `mapstructure:"secret" json:"secret,omitempty" yaml:"secret,omitempty"`
+	SecretFile string            `mapstructure:"secret_file" json:"secret_file,omitempty" yaml:"secret_file,omitempty"`
+	SecretEnv  string            `mapstructure:"secret_env" json:"secret_env,omitempty" yaml:"secret_env,omitempty"`
+	Headers    map[string]string `mapstructure:"headers" json:"headers,omitempty" yaml:"headers,omitempty"`
+	// If not set the values of the http settings are used.
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// A negative value disables the retries.
+	Retries int           `mapstructure:"retries" json:"retries,omitempty" yaml:"retries,omitempty"`
+	Backoff time.Duration `mapstructure:"backoff" json:"backoff,omitempty" yaml:"backoff,omitempty"`
 }
 
 type BuilderTreeConfig struct {
-	Viper *v.Viper
+	Viper *v.Viper `yaml:"-"`
 
-	Prefix     string                 `mapstructure:"prefix"`
-	ImagesPath string                 `mapstructure:"images_path"`
-	DataType   string                 `mapstructure:"datatype"`
-	Format     string                 `mapstructure:"format"`
-	Products   []SimpleStreamsProduct `mapstructure:"products"`
+	Prefix     string                  `mapstructure:"prefix" yaml:"prefix"`
+	ImagesPath string                  `mapstructure:"images_path" yaml:"images_path"`
+	DataType   string                  `mapstructure:"datatype" yaml:"datatype"`
+	Format     string                  `mapstructure:"format" yaml:"format"`
+	Products   []SimpleStreamsProduct  `mapstructure:"products" yaml:"products"`
+	ItemTypes  []SimpleStreamsItemType `mapstructure:"item_types" yaml:"item_types"`
+	Http       HttpClientConfig        `mapstructure:"http" yaml:"http"`
+	Auth       []HttpAuthConfig        `mapstructure:"auth" yaml:"auth"`
+	// Public url of the tree used to build the url of the artifacts.
+	BaseUrl  string          `mapstructure:"base_url" yaml:"base_url"`
+	Webhooks []WebhookConfig `mapstructure:"webhooks" yaml:"webhooks"`
+	// Files merged with the main file. Relative paths are resolved
+	// from the directory of the file that contains the include.
+	Include []string `mapstructure:"include" yaml:"include"`
+	// Values used for the interpolation of {{ .Values.key }}.
+	Values map[string]interface{} `mapstructure:"values" yaml:"values"`
+	// Directory with the image files used to complete the products.
+	// Relative paths are resolved from the directory of the main file.
+	DefinitionsDir string `mapstructure:"definitions_dir" yaml:"definitions_dir"`
+	// Templates of the aliases generated for all products.
+	AliasTemplates []string `mapstructure:"alias_templates" yaml:"alias_templates"`
 }
 
 func NewBuilderTreeConfig(viper *v.Viper) *BuilderTreeConfig {
@@ -70,27 +204,81 @@ func GenDefault(viper *v.Viper) {
 	viper.SetDefault("images_path", "streams/v1")
 	viper.SetDefault("datatype", "image-downloads")
 	viper.SetDefault("format", "products:1.0")
+
+	viper.SetDefault("http.timeout", "60s")
+	viper.SetDefault("http.retries", 3)
+	viper.SetDefault("http.backoff", "1s")
+	viper.SetDefault("http.max_backoff", "30s")
+	viper.SetDefault("http.proxy", "")
+	viper.SetDefault("http.concurrency", 4)
+	viper.SetDefault("http.cache_dir", "")
 }
 
 func (b *BuilderTreeConfig) Unmarshal() error {
 	var err error
 
-	err = b.Viper.ReadInConfig()
+	// Merge the included files and the products.d files
+	// with the variables interpolated.
+	tree, err := LoadTree(b.Viper.ConfigFileUsed(),
+		b.Viper.GetStringSlice("values-file"))
 	if err != nil {
 		return err
 	}
 
-	err = b.Viper.Unmarshal(&b)
+	data, err := tree.Marshal()
 	if err != nil {
 		return err
 	}
 
+	err = b.Viper.ReadConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	err = b.Viper.Unmarshal(&b, decodeHooks())
+	if err != nil {
+		return err
+	}
+
+	// POST: the values files override the values of the tree.
+	b.Values = tree.Values
+
+	for idx := range b.Products {
+		if idx < len(tree.ProductSources) {
+			b.Products[idx].Source = tree.ProductSources[idx]
+		}
+
+		vars, err := tree.ProductVars(idx)
+		if err != nil {
+			return err
+		}
+		if vars != nil {
+			b.Products[idx].Vars = vars
+		}
+	}
+
 	for idx, v := range b.Products {
 		if v.Days <= 0 {
 			b.Products[idx].Days = 1
 		}
 	}
 
+	if b.Http.Concurrency <= 0 {
+		b.Http.Concurrency = 1
+	}
+	if b.Http.Retries < 0 {
+		b.Http.Retries = 0
+	}
+
+	for idx, w := range b.Webhooks {
+		if w.Url == "" {
+			return fmt.Errorf("Webhook %d (%s) without url", idx, w.Name)
+		}
+		if w.Name == "" {
+			b.Webhooks[idx].Name = w.Url
+		}
+	}
+
 	return err
 }
 
@@ -105,15 +293,42 @@ func (b *BuilderTreeConfig) String() string {
 		}
 	}
 
+	var itemTypes string = ""
+
+	for _, t := range b.ItemTypes {
+		itemTypes = fmt.Sprintf("%s\n%s", itemTypes, t.String())
+	}
+
+	var auth string = ""
+
+	for _, a := range b.Auth {
+		auth = fmt.Sprintf("%s\n%s", auth, a.String())
+	}
+
+	var webhooks string = ""
+
+	for _, w := range b.Webhooks {
+		webhooks = fmt.Sprintf("%s\n%s", webhooks, w.String())
+	}
+
 	var ans string = fmt.Sprintf(`
 prefix: %s
 images_path: %s
 datatype: %s
 format: %s
+base_url: %s
+include: %s
+values: %v
+definitions_dir: %s
+alias_templates: %s
+item_types:%s
+http:%s
+auth:%s
+webhooks:%s
 products:
 %s
 `, b.Prefix, b.ImagesPath, b.DataType,
-		b.Format, products)
+		b.Format, b.BaseUrl, b.Include, b.Values, b.DefinitionsDir, b.AliasTemplates, itemTypes, b.Http.String(), auth, webhooks, products)
 
 	return ans
 }
@@ -126,17 +341,108 @@ func (p *SimpleStreamsProduct) String() string {
 	release: %s
 	release_title: %s
 	os: %s
+	variant: %s
 	directory: %s
 	version: %s
 	prefix_path: %s
 	hidden: %v
 	days: %d
 	build_script_hook: %s
-	aliases: %s`,
+	item_types: %s
+	support_eol: %s
+	expiry: %s
+	definition_overrides: %v
+	options: %v
+	vars: %v
+	metadata_mode: %s
+	completeness: %s
+	alias_templates: %s
+	default: %v
+	aliases: %s
+	source: %s`,
 		p.Name, p.Architecture, p.Release,
-		p.ReleaseTitle, p.OperatingSystem,
+		p.ReleaseTitle, p.OperatingSystem, p.Variant,
 		p.Directory, p.Version, p.PrefixPath,
-		p.Hidden, p.Days, p.BuildScriptHook, p.Aliases)
+		p.Hidden, p.Days, p.BuildScriptHook, p.ItemTypes,
+		p.SupportEOL, p.Expiry, p.DefinitionOverrides, p.Options, p.Vars, p.MetadataMode, p.Completeness.String(),
+		p.AliasTemplates, p.Default,
+		p.Aliases, p.Source)
+
+	if p.Auth != nil {
+		ans += fmt.Sprintf("\n\tauth: %s", p.Auth.String())
+	}
 
 	return ans
 }
+
+func (t *SimpleStreamsItemType) String() string {
+	return fmt.Sprintf(`
+	name: %s
+	pattern: %s
+	ftype: %s
+	kind: %s
+	combined_hash: %s
+	default: %v`,
+		t.Name, t.Pattern, t.FileType, t.Kind, t.CombinedHash, t.Default)
+}
+
+func (h *HttpClientConfig) String() string {
+	return fmt.Sprintf(`
+	timeout: %s
+	retries: %d
+	backoff: %s
+	max_backoff: %s
+	proxy: %s
+	concurrency: %d
+	cache_dir: %s`,
+		h.Timeout, h.Retries, h.Backoff, h.MaxBackoff,
+		h.Proxy, h.Concurrency, h.CacheDir)
+}
+
+// String returns the settings without the secrets.
+func (a *HttpAuthConfig) String() string {
+	var secret string = ""
+
+	if a.Token != "" || a.Password != "" {
+		secret = "<inline>"
+	} else if a.TokenFile != "" || a.PasswordFile != "" {
+		secret = "<file>"
+	} else if a.TokenEnv != "" || a.PasswordEnv != "" {
+		secret = "<env>"
+	}
+
+	return fmt.Sprintf(`
+	host: %s
+	type: %s
+	username: %s
+	secret: %s
+	netrc_file: %s
+	ca_bundle: %s
+	client_cert: %s
+	insecure_skipverify: %v`,
+		a.Host, a.Type, a.Username, secret, a.NetrcFile,
+		a.CABundle, a.ClientCert, a.InsecureSkipVerify)
+}
+
+// String returns the settings without the secret.
+func (w *WebhookConfig) String() string {
+	var secret string = ""
+
+	if w.Secret != "" {
+		secret = "<inline>"
+	} else if w.SecretFile != "" {
+		secret = "<file>"
+	} else if w.SecretEnv != "" {
+		secret = "<env>"
+	}
+
+	return fmt.Sprintf(`
+	name: %s
+	url: %s
+	events: %s
+	secret: %s
+	timeout: %s
+	retries: %d
+	backoff: %s`,
+		w.Name, w.Url, w.Events, secret, w.Timeout, w.Retries, w.Backoff)
+}
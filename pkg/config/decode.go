@@ -0,0 +1,92 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	v "github.com/spf13/viper"
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// decodeHooks returns the option of viper with the decode hooks used to
+// unmarshal the configuration. The default hooks of viper are kept.
+func decodeHooks() v.DecoderConfigOption {
+	return v.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		secondsToDurationHook,
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		timeToStringHook,
+	))
+}
+
+// decodeTree decodes the configuration parsed from the YAML file with
+// the options used by viper on Unmarshal, so the validation accepts the
+// same values of the load.
+func decodeTree(input, output interface{}) error {
+	c := &mapstructure.DecoderConfig{
+		Result:           output,
+		WeaklyTypedInput: true,
+	}
+	decodeHooks()(c)
+
+	decoder, err := mapstructure.NewDecoder(c)
+	if err != nil {
+		return err
+	}
+
+	err = decoder.Decode(input)
+	if merr, ok := err.(*mapstructure.Error); ok {
+		// POST: one line with all the errors.
+		return errors.New(strings.Join(merr.Errors, "; "))
+	}
+
+	return err
+}
+
+// timeToStringHook converts the YAML timestamps not quoted, for example
+// support_eol: 2024-12-31, to the strings parsed by tools.ParseDate.
+func timeToStringHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if from != timeType || to.Kind() != reflect.String {
+		return data, nil
+	}
+
+	t := data.(time.Time)
+	if t.Equal(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())) {
+		return t.Format("2006-01-02"), nil
+	}
+	return t.Format(time.RFC3339), nil
+}
+
+// secondsToDurationHook converts the numbers without unit, for example
+// timeout: 30, to a duration in seconds instead of nanoseconds.
+func secondsToDurationHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != durationType || from == durationType {
+		return data, nil
+	}
+
+	switch from.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return time.Duration(reflect.ValueOf(data).Int()) * time.Second, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return time.Duration(reflect.ValueOf(data).Uint()) * time.Second, nil
+	case reflect.Float32, reflect.Float64:
+		return time.Duration(reflect.ValueOf(data).Float() * float64(time.Second)), nil
+	case reflect.String:
+		if n, err := strconv.ParseFloat(data.(string), 64); err == nil {
+			return time.Duration(n * float64(time.Second)), nil
+		}
+	}
+
+	return data, nil
+}
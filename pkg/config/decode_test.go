@@ -0,0 +1,35 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package config
+
+import (
+	"testing"
+	"time"
+
+	v "github.com/spf13/viper"
+)
+
+func TestDecodeDurations(t *testing.T) {
+	viper := v.New()
+	viper.Set("http", map[string]interface{}{
+		"timeout":     30,
+		"backoff":     "2",
+		"max_backoff": "1m",
+	})
+
+	c := NewBuilderTreeConfig(viper)
+	if err := viper.Unmarshal(c, decodeHooks()); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+
+	if c.Http.Timeout != 30*time.Second {
+		t.Errorf("Expected timeout 30s, got %s", c.Http.Timeout)
+	}
+	if c.Http.Backoff != 2*time.Second {
+		t.Errorf("Expected backoff 2s, got %s", c.Http.Backoff)
+	}
+	if c.Http.MaxBackoff != time.Minute {
+		t.Errorf("Expected max_backoff 1m, got %s", c.Http.MaxBackoff)
+	}
+}
@@ -0,0 +1,31 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package config
+
+// Kinds of the item types.
+const (
+	ItemKindMetadata = "metadata"
+	ItemKindRootfs   = "rootfs"
+)
+
+// Names of the builtin item types. They are the keys of the items
+// on the versions of the manifests.
+const (
+	ItemTypeLxdTarXz     = "lxd.tar.xz"
+	ItemTypeIncusTarXz   = "incus.tar.xz"
+	ItemTypeRootSquashFs = "root.squashfs"
+	ItemTypeRootTarXz    = "root.tar.xz"
+	ItemTypeRootTarZst   = "root.tar.zst"
+	ItemTypeRootTarGz    = "root.tar.gz"
+	ItemTypeDiskKvmImg   = "disk-kvm.img"
+)
+
+// BuiltinItemTypes returns the names of the builtin item types.
+func BuiltinItemTypes() []string {
+	return []string{
+		ItemTypeLxdTarXz, ItemTypeIncusTarXz, ItemTypeRootSquashFs,
+		ItemTypeRootTarXz, ItemTypeRootTarZst, ItemTypeRootTarGz,
+		ItemTypeDiskKvmImg,
+	}
+}
@@ -0,0 +1,631 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ProductsDir is the directory, relative to the main configuration
+// file, with the files of the products merged at load time.
+const ProductsDir = "products.d"
+
+var (
+	envVarRegex   = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+	valueRefRegex = regexp.MustCompile(`\{\{\s*\.(Values|Env)((?:\.[A-Za-z0-9_-]+)+)\s*\}\}`)
+)
+
+// ResolvedTree contains the configuration merged from the main file,
+// the included files and the files of the products directory with
+// the variables interpolated.
+type ResolvedTree struct {
+	// Main configuration file.
+	File string
+	// Files loaded in order.
+	Files []string
+	Root  *yaml.Node
+	// Values used for the interpolation.
+	Values map[string]interface{}
+	// File of every product in the order of the products list.
+	ProductSources []string
+
+	nodeFiles map[*yaml.Node]string
+}
+
+type treeLoader struct {
+	tree    *ResolvedTree
+	visited map[string]bool
+}
+
+// LoadTree reads the main configuration file and merges the included
+// files and the files under products.d. The values files override
+// the values defined on the main file.
+func LoadTree(file string, valuesFiles []string) (*ResolvedTree, error) {
+	l := &treeLoader{
+		tree: &ResolvedTree{
+			File:           file,
+			Files:          []string{},
+			ProductSources: []string{},
+			nodeFiles:      make(map[*yaml.Node]string, 0),
+		},
+		visited: make(map[string]bool, 0),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := l.readValues(file, data, valuesFiles)
+	if err != nil {
+		return nil, err
+	}
+	l.tree.Values = values
+
+	root, err := l.loadFile(file, true)
+	if err != nil {
+		return nil, err
+	}
+	l.tree.Root = root
+
+	// The resolved tree contains the values merged with the values files.
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "values" && len(valuesFiles) > 0 {
+			vnode := &yaml.Node{}
+			err = vnode.Encode(values)
+			if err != nil {
+				return nil, err
+			}
+			l.markFile(vnode, file)
+			root.Content[i+1] = vnode
+		}
+	}
+
+	// Merge the products of products.d
+	dir := filepath.Join(filepath.Dir(file), ProductsDir)
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		files, err := globFiles(dir, []string{"*.yml", "*.yaml"})
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			err = l.mergeProductsFile(f)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return l.tree, nil
+}
+
+// ProductVars returns the vars of the product at the index idx with
+// the keys in the original case. Viper lowercases the keys of the maps.
+func (t *ResolvedTree) ProductVars(idx int) (map[string]interface{}, error) {
+	var ans map[string]interface{}
+
+	products := mappingValue(t.Root, "products")
+	if products == nil || products.Kind != yaml.SequenceNode || idx >= len(products.Content) {
+		return nil, nil
+	}
+
+	vars := mappingValue(products.Content[idx], "vars")
+	if vars == nil {
+		return nil, nil
+	}
+
+	err := vars.Decode(&ans)
+	if err != nil {
+		return nil, fmt.Errorf("Error on decode vars of product %d: %s", idx, err.Error())
+	}
+
+	return ans, nil
+}
+
+// FileOf returns the file that contains the node.
+func (t *ResolvedTree) FileOf(n *yaml.Node) string {
+	if f, ok := t.nodeFiles[n]; ok {
+		return f
+	}
+	return t.File
+}
+
+// Marshal returns the resolved configuration in YAML format. The
+// products contain a comment with the source file.
+func (t *ResolvedTree) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err := enc.Encode(t.Root)
+	if err != nil {
+		return nil, err
+	}
+	err = enc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readValues returns the values of the main file merged with
+// the values files.
+func (l *treeLoader) readValues(file string, data []byte, valuesFiles []string) (map[string]interface{}, error) {
+	var doc struct {
+		Values map[string]interface{} `yaml:"values"`
+	}
+
+	root, err := parseYaml(file, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// POST: the values can't reference other values. The references
+	// are removed to decode the values.
+	err = interpolate(file, root, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = root.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("Error on parse %s: %s", file, err.Error())
+	}
+
+	ans := doc.Values
+	if ans == nil {
+		ans = make(map[string]interface{}, 0)
+	}
+
+	for _, vf := range valuesFiles {
+		var values map[string]interface{}
+
+		vdata, err := ioutil.ReadFile(vf)
+		if err != nil {
+			return nil, fmt.Errorf("Error on read values file %s: %s", vf, err.Error())
+		}
+
+		vroot, err := parseYaml(vf, vdata)
+		if err != nil {
+			return nil, err
+		}
+
+		err = interpolate(vf, vroot, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		err = vroot.Decode(&values)
+		if err != nil {
+			return nil, fmt.Errorf("Error on parse values file %s: %s", vf, err.Error())
+		}
+
+		mergeValues(ans, values)
+	}
+
+	return ans, nil
+}
+
+// loadFile reads, interpolates and parses a configuration file and
+// merges the included files.
+func (l *treeLoader) loadFile(file string, main bool) (*yaml.Node, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	if l.visited[abs] {
+		return nil, fmt.Errorf("Include loop on file %s", file)
+	}
+	l.visited[abs] = true
+
+	doc, err := l.render(file)
+	if err != nil {
+		return nil, err
+	}
+	l.tree.Files = append(l.tree.Files, file)
+
+	if len(doc.Content) == 0 {
+		// Empty file
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: 1, Column: 1}, nil
+	}
+
+	root := doc.Content[0]
+	l.markFile(root, file)
+
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: the configuration must be a map", file, root.Line)
+	}
+
+	if !main && mappingValue(root, "values") != nil {
+		return nil, fmt.Errorf("%s:%d: values are allowed only on the main file",
+			file, mappingValue(root, "values").Line)
+	}
+
+	l.recordProducts(root, file)
+
+	includes := mappingValue(root, "include")
+	if includes == nil {
+		return root, nil
+	}
+
+	if includes.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s:%d: include must be a list", file, includes.Line)
+	}
+
+	for _, inc := range includes.Content {
+		pattern := inc.Value
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(file), pattern)
+		}
+
+		files, err := globFiles("", []string{pattern})
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, inc.Line, err.Error())
+		}
+		if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("%s:%d: included file %s not found",
+				file, inc.Line, inc.Value)
+		}
+
+		for _, f := range files {
+			child, err := l.loadFile(f, false)
+			if err != nil {
+				return nil, err
+			}
+			err = l.mergeMapping(root, child, f)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return root, nil
+}
+
+// mergeProductsFile merges a file of products.d. The file could
+// contain a product or a list of products.
+func (l *treeLoader) mergeProductsFile(file string) error {
+	doc, err := l.render(file)
+	if err != nil {
+		return err
+	}
+	l.tree.Files = append(l.tree.Files, file)
+
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	n := doc.Content[0]
+	l.markFile(n, file)
+
+	products := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: n.Line, Column: n.Column}
+	switch n.Kind {
+	case yaml.SequenceNode:
+		products.Content = n.Content
+	case yaml.MappingNode:
+		products.Content = []*yaml.Node{n}
+	default:
+		return fmt.Errorf("%s:%d: expected a product or a list of products", file, n.Line)
+	}
+	l.markFile(products, file)
+
+	wrapper := &yaml.Node{
+		Kind: yaml.MappingNode,
+		Tag:  "!!map",
+		Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: "products", Line: n.Line, Column: n.Column},
+			products,
+		},
+	}
+	l.markFile(wrapper, file)
+	l.recordProducts(wrapper, file)
+
+	return l.mergeMapping(l.tree.Root, wrapper, file)
+}
+
+// mergeMapping merges the source mapping into the destination. The
+// lists are appended, the maps are merged and the scalars defined in
+// both files must have the same value.
+func (l *treeLoader) mergeMapping(dst, src *yaml.Node, file string) error {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+
+		if key.Value == "include" {
+			// POST: already processed
+			continue
+		}
+
+		current := mappingValue(dst, key.Value)
+		if current == nil {
+			dst.Content = append(dst.Content, key, value)
+			continue
+		}
+
+		switch {
+		case current.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+			current.Content = append(current.Content, value.Content...)
+		case current.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			err := l.mergeMapping(current, value, file)
+			if err != nil {
+				return err
+			}
+		case current.Tag == "!!null":
+			// Replace the empty value.
+			for j := 0; j+1 < len(dst.Content); j += 2 {
+				if dst.Content[j].Value == key.Value {
+					dst.Content[j+1] = value
+				}
+			}
+		case value.Tag == "!!null":
+		case current.Kind == yaml.ScalarNode && value.Kind == yaml.ScalarNode &&
+			current.Value == value.Value:
+		default:
+			return fmt.Errorf("%s:%d: key %s already defined on %s:%d",
+				file, key.Line, key.Value, l.tree.FileOf(current), current.Line)
+		}
+	}
+
+	return nil
+}
+
+// recordProducts registers the source file of the products defined
+// on the mapping. The files are processed in the merge order.
+func (l *treeLoader) recordProducts(root *yaml.Node, file string) {
+	products := mappingValue(root, "products")
+	if products == nil || products.Kind != yaml.SequenceNode {
+		return
+	}
+	for _, p := range products.Content {
+		p.HeadComment = "source: " + file
+		l.tree.ProductSources = append(l.tree.ProductSources, file)
+	}
+}
+
+// render reads and parses the file and interpolates the environment
+// variables and the values.
+func (l *treeLoader) render(file string) (*yaml.Node, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := parseYaml(file, data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = interpolate(file, doc, l.tree.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+func parseYaml(file string, data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("Error on parse %s: %s", file, err.Error())
+	}
+
+	return &doc, nil
+}
+
+// interpolate replaces the environment variables and the values on the
+// scalars of the parsed document, so the comments are ignored and the
+// values can't change the structure of the document. If values is nil
+// the references to the values are removed.
+func interpolate(file string, n *yaml.Node, values map[string]interface{}) error {
+	var errs []string
+
+	walkScalars(n, func(s *yaml.Node) {
+		value, err := expandEnv(file, s.Line, s.Value)
+		if err == nil {
+			if values == nil {
+				value = valueRefRegex.ReplaceAllString(value, "")
+			} else {
+				value, err = expandValues(file, s.Line, value, values)
+			}
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			return
+		}
+
+		if value != s.Value {
+			s.Value = value
+			if s.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|
+				yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				// The tag of a plain scalar is resolved from the
+				// new value, for example days: ${DAYS} is an int.
+				s.Tag = ""
+			}
+		}
+	})
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+
+	return nil
+}
+
+func walkScalars(n *yaml.Node, f func(s *yaml.Node)) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		f(n)
+	case yaml.AliasNode:
+		// POST: the anchor is walked on its position.
+	default:
+		for _, c := range n.Content {
+			walkScalars(c, f)
+		}
+	}
+}
+
+func (l *treeLoader) markFile(n *yaml.Node, file string) {
+	if _, ok := l.tree.nodeFiles[n]; ok {
+		return
+	}
+	l.tree.nodeFiles[n] = file
+	for _, c := range n.Content {
+		l.markFile(c, file)
+	}
+}
+
+// expandEnv replaces ${VAR} and ${VAR:-default} with the value of the
+// environment variable. $${VAR} is replaced with ${VAR}. The text
+// starts at the line in input of the file.
+func expandEnv(file string, line int, text string) (string, error) {
+	var b strings.Builder
+	var errs []string
+	last := 0
+
+	for _, m := range envVarRegex.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(text[last:m[0]])
+		last = m[1]
+
+		match := text[m[0]:m[1]]
+		if strings.HasPrefix(match, "$$") {
+			b.WriteString(match[1:])
+			continue
+		}
+
+		name := text[m[2]:m[3]]
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			if m[4] >= 0 {
+				value = text[m[6]:m[7]]
+			} else if !ok {
+				errs = append(errs, fmt.Sprintf("%s:%d: environment variable %s not defined",
+					file, line+lineOf(text, m[0])-1, name))
+			}
+		}
+		b.WriteString(value)
+	}
+	b.WriteString(text[last:])
+
+	if len(errs) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+
+	return b.String(), nil
+}
+
+// expandValues replaces {{ .Values.key }} and {{ .Env.VAR }} with the
+// value. Nested values are available with dots: {{ .Values.a.b }}.
+func expandValues(file string, line int, text string, values map[string]interface{}) (string, error) {
+	var b strings.Builder
+	var errs []string
+	last := 0
+
+	for _, m := range valueRefRegex.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(text[last:m[0]])
+		last = m[1]
+
+		kind := text[m[2]:m[3]]
+		keys := strings.Split(strings.TrimPrefix(text[m[4]:m[5]], "."), ".")
+
+		if kind == "Env" {
+			value, ok := os.LookupEnv(keys[0])
+			if !ok || len(keys) > 1 {
+				errs = append(errs, fmt.Sprintf("%s:%d: environment variable %s not defined",
+					file, line+lineOf(text, m[0])-1, strings.Join(keys, ".")))
+			}
+			b.WriteString(value)
+			continue
+		}
+
+		var current interface{} = values
+		for _, k := range keys {
+			mv, ok := current.(map[string]interface{})
+			if !ok {
+				current = nil
+				break
+			}
+			current, ok = mv[k]
+			if !ok {
+				current = nil
+				break
+			}
+		}
+
+		switch current.(type) {
+		case nil:
+			errs = append(errs, fmt.Sprintf("%s:%d: value %s not defined",
+				file, line+lineOf(text, m[0])-1, strings.Join(keys, ".")))
+		case map[string]interface{}, []interface{}:
+			errs = append(errs, fmt.Sprintf("%s:%d: value %s is not a scalar",
+				file, line+lineOf(text, m[0])-1, strings.Join(keys, ".")))
+		default:
+			b.WriteString(fmt.Sprint(current))
+		}
+	}
+	b.WriteString(text[last:])
+
+	if len(errs) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+
+	return b.String(), nil
+}
+
+// mergeValues merges src into dst. The maps are merged recursively.
+func mergeValues(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sm, ok := v.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				mergeValues(dm, sm)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// globFiles returns the sorted files that match the patterns. The
+// patterns are relative to the directory if not empty.
+func globFiles(dir string, patterns []string) ([]string, error) {
+	ans := []string{}
+	for _, p := range patterns {
+		if dir != "" {
+			p = filepath.Join(dir, p)
+		}
+		files, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, files...)
+	}
+	sort.Strings(ans)
+	return ans, nil
+}
+
+func lineOf(text string, offset int) int {
+	return strings.Count(text[:offset], "\n") + 1
+}
@@ -0,0 +1,34 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package config
+
+import (
+	"fmt"
+)
+
+// Metadata modes of a product. They define which metadata tarballs are
+// built and how they are published.
+const (
+	// Only lxd.tar.xz is built and published.
+	MetadataModeLxdOnly = "lxd-only"
+	// Only incus.tar.xz is built and published.
+	MetadataModeIncusOnly = "incus-only"
+	// The metadata tarball built is published also with the ftype
+	// of the other format. It's the default.
+	MetadataModeBridged = "bridged"
+	// Both lxd.tar.xz and incus.tar.xz are built and published.
+	MetadataModeNativeBoth = "native-both"
+)
+
+// CheckMetadataMode returns an error if the mode is not supported.
+// An empty mode is the bridged mode.
+func CheckMetadataMode(mode string) error {
+	switch mode {
+	case "", MetadataModeLxdOnly, MetadataModeIncusOnly,
+		MetadataModeBridged, MetadataModeNativeBoth:
+		return nil
+	}
+	return fmt.Errorf("Invalid metadata mode %q. Use %s, %s, %s or %s", mode,
+		MetadataModeLxdOnly, MetadataModeIncusOnly, MetadataModeBridged, MetadataModeNativeBoth)
+}
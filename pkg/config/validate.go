@@ -0,0 +1,611 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	tools "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
+)
+
+// ValidationProblem describes an error of the configuration file.
+type ValidationProblem struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationError contains all the problems found on the
+// configuration file.
+type ValidationError struct {
+	Problems []ValidationProblem
+}
+
+type ValidateOptions struct {
+	// Top level keys accepted in addition to the keys of the tree.
+	// For example the keys of the flags bound to viper.
+	ExtraKeys []string
+	// Check that the hook scripts exist.
+	CheckFiles bool
+	// If not empty check that the image file of the local products
+	// exists under the product directory or under the source directory.
+	SourceDir     string
+	ImageFilename string
+	// Files with the values used for the interpolation.
+	ValuesFiles []string
+}
+
+type configValidator struct {
+	tree     *ResolvedTree
+	opts     ValidateOptions
+	problems []ValidationProblem
+}
+
+func (p ValidationProblem) String() string {
+	if p.Path != "" {
+		return fmt.Sprintf("%s:%d:%d: %s: %s", p.File, p.Line, p.Column, p.Path, p.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, p.Message)
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{
+		fmt.Sprintf("Found %d problems on configuration file:", len(e.Problems)),
+	}
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ValidateFile checks the configuration file with the included files
+// and returns all the problems found. The error is returned only if
+// a file is not readable, it isn't a valid YAML file or the
+// interpolation fails.
+func ValidateFile(file string, opts ValidateOptions) ([]ValidationProblem, error) {
+	tree, err := LoadTree(file, opts.ValuesFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return ValidateTree(tree, opts), nil
+}
+
+// ValidateTree checks the resolved configuration.
+func ValidateTree(tree *ResolvedTree, opts ValidateOptions) []ValidationProblem {
+	v := &configValidator{
+		tree:     tree,
+		opts:     opts,
+		problems: []ValidationProblem{},
+	}
+
+	root := tree.Root
+	v.checkNode(root, reflect.TypeOf(BuilderTreeConfig{}), "", opts.ExtraKeys)
+
+	// The unknown keys are ignored by the decode. If the values
+	// are not valid the semantic checks are skipped.
+	if root.Kind == yaml.MappingNode {
+		var data interface{}
+		c := &BuilderTreeConfig{}
+
+		err := root.Decode(&data)
+		if err == nil {
+			err = decodeTree(data, c)
+		}
+		if err != nil {
+			v.add(root, "", fmt.Sprintf("Invalid configuration, semantic checks skipped: %s",
+				err.Error()))
+		} else {
+			v.checkTree(root, c)
+		}
+	}
+
+	files := map[string]int{}
+	for idx, f := range tree.Files {
+		files[f] = idx
+	}
+
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		fi, fj := files[v.problems[i].File], files[v.problems[j].File]
+		if fi != fj {
+			return fi < fj
+		}
+		if v.problems[i].Line != v.problems[j].Line {
+			return v.problems[i].Line < v.problems[j].Line
+		}
+		return v.problems[i].Column < v.problems[j].Column
+	})
+
+	return v.problems
+}
+
+func (v *configValidator) add(n *yaml.Node, p, msg string) {
+	v.problems = append(v.problems, ValidationProblem{
+		File:    v.tree.FileOf(n),
+		Line:    n.Line,
+		Column:  n.Column,
+		Path:    p,
+		Message: msg,
+	})
+}
+
+// checkNode compares the node with the type through the mapstructure
+// tags and reports unknown keys and invalid values.
+func (v *configValidator) checkNode(n *yaml.Node, t reflect.Type, p string, extraKeys []string) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == durationType {
+		if n.Kind != yaml.ScalarNode {
+			v.add(n, p, "Expected a duration")
+		} else if _, err := time.ParseDuration(n.Value); err != nil {
+			// A number without unit is a number of seconds.
+			if _, ferr := strconv.ParseFloat(n.Value, 64); ferr != nil {
+				v.add(n, p, fmt.Sprintf("Invalid duration %q", n.Value))
+			}
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			v.add(n, p, "Expected a map")
+			return
+		}
+
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("mapstructure"), ",")[0]
+			if tag != "" && tag != "-" {
+				fields[tag] = t.Field(i).Type
+			}
+		}
+
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			kp := joinPath(p, key.Value)
+
+			ft, ok := fields[key.Value]
+			if !ok {
+				// viper accepts the keys in case insensitive mode.
+				for name, t := range fields {
+					if strings.EqualFold(name, key.Value) {
+						ft, ok = t, true
+						break
+					}
+				}
+			}
+			if !ok {
+				if !containsKey(extraKeys, key.Value) {
+					v.add(key, kp, fmt.Sprintf("Unknown key %s%s", key.Value,
+						suggestKey(key.Value, fields)))
+				}
+				continue
+			}
+
+			v.checkNode(value, ft, kp, nil)
+		}
+
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			if n.Tag == "!!null" {
+				return
+			}
+			v.add(n, p, "Expected a list")
+			return
+		}
+		for idx, item := range n.Content {
+			v.checkNode(item, t.Elem(), fmt.Sprintf("%s[%d]", p, idx), nil)
+		}
+
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			if n.Tag == "!!null" {
+				return
+			}
+			v.add(n, p, "Expected a map")
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			v.checkNode(n.Content[i+1], t.Elem(), joinPath(p, n.Content[i].Value), nil)
+		}
+
+	case reflect.Bool:
+		if n.Kind != yaml.ScalarNode {
+			v.add(n, p, "Expected a boolean")
+		} else if _, err := strconv.ParseBool(n.Value); err != nil {
+			v.add(n, p, fmt.Sprintf("Invalid boolean %q", n.Value))
+		}
+
+	case reflect.Int, reflect.Int64:
+		if n.Kind != yaml.ScalarNode {
+			v.add(n, p, "Expected an integer")
+		} else if _, err := strconv.Atoi(n.Value); err != nil {
+			v.add(n, p, fmt.Sprintf("Invalid integer %q", n.Value))
+		}
+
+	case reflect.String:
+		if n.Kind != yaml.ScalarNode {
+			v.add(n, p, "Expected a string")
+		}
+	}
+}
+
+// checkTree executes the semantic checks of the tree.
+func (v *configValidator) checkTree(root *yaml.Node, tree *BuilderTreeConfig) {
+	names := map[string]int{}
+	dirs := map[string]int{}
+	itemTypes := map[string]bool{}
+	for _, name := range BuiltinItemTypes() {
+		itemTypes[name] = true
+	}
+
+	for idx, t := range tree.ItemTypes {
+		p := fmt.Sprintf("item_types[%d]", idx)
+		n := nodeAt(root, "item_types", idx)
+		if t.Name == "" {
+			v.add(n, p, "Missing required field name")
+		}
+		if t.Pattern == "" {
+			v.add(n, p, "Missing required field pattern")
+		}
+		if t.Kind != ItemKindMetadata && t.Kind != ItemKindRootfs {
+			v.add(nodeAt(root, "item_types", idx, "kind"), p+".kind",
+				fmt.Sprintf("Invalid kind %q. Use metadata or rootfs", t.Kind))
+		}
+		itemTypes[t.Name] = true
+	}
+
+	for idx := range tree.Auth {
+		p := fmt.Sprintf("auth[%d]", idx)
+		if tree.Auth[idx].Host == "" {
+			v.add(nodeAt(root, "auth", idx), p, "Missing required field host")
+		}
+		v.checkAuth(nodeAt(root, "auth", idx), p, &tree.Auth[idx])
+	}
+
+	for idx, w := range tree.Webhooks {
+		p := fmt.Sprintf("webhooks[%d]", idx)
+		if w.Url == "" {
+			v.add(nodeAt(root, "webhooks", idx), p, "Missing required field url")
+		} else {
+			v.checkUrl(nodeAt(root, "webhooks", idx, "url"), p+".url", w.Url)
+		}
+	}
+
+	if tree.BaseUrl != "" {
+		v.checkUrl(nodeAt(root, "base_url"), "base_url", tree.BaseUrl)
+	}
+
+	for idx, t := range tree.AliasTemplates {
+		if err := CheckAliasTemplate(t); err != nil {
+			v.add(nodeAt(root, "alias_templates", idx),
+				fmt.Sprintf("alias_templates[%d]", idx), err.Error())
+		}
+	}
+
+	for idx := range tree.Products {
+		prod := &tree.Products[idx]
+		p := fmt.Sprintf("products[%d]", idx)
+		n := nodeAt(root, "products", idx)
+
+		if prod.Name == "" {
+			v.add(n, p, "Missing required field name")
+		} else if first, ok := names[prod.Name]; ok {
+			v.add(nodeAt(root, "products", idx, "name"), p+".name",
+				fmt.Sprintf("Duplicate product name %s (also on products[%d])",
+					prod.Name, first))
+		} else {
+			names[prod.Name] = idx
+		}
+
+		if prod.Directory == "" {
+			v.add(n, p, "Missing required field directory")
+		} else {
+			key := strings.TrimRight(prod.PrefixPath, "/") + "|" +
+				strings.Trim(path.Clean(prod.Directory), "/")
+			if first, ok := dirs[key]; ok {
+				v.add(nodeAt(root, "products", idx, "directory"), p+".directory",
+					fmt.Sprintf("Duplicate directory %s (also on products[%d])",
+						prod.Directory, first))
+			} else {
+				dirs[key] = idx
+			}
+		}
+
+		if prod.PrefixPath != "" {
+			v.checkUrl(nodeAt(root, "products", idx, "prefix_path"),
+				p+".prefix_path", prod.PrefixPath)
+		}
+
+		for tidx, t := range prod.ItemTypes {
+			if !itemTypes[t] {
+				v.add(nodeAt(root, "products", idx, "item_types", tidx),
+					fmt.Sprintf("%s.item_types[%d]", p, tidx),
+					fmt.Sprintf("Unknown item type %s", t))
+			}
+		}
+
+		if err := CheckMetadataMode(prod.MetadataMode); err != nil {
+			v.add(nodeAt(root, "products", idx, "metadata_mode"), p+".metadata_mode",
+				err.Error())
+		}
+
+		for tidx, t := range prod.AliasTemplates {
+			if err := CheckAliasTemplate(t); err != nil {
+				v.add(nodeAt(root, "products", idx, "alias_templates", tidx),
+					fmt.Sprintf("%s.alias_templates[%d]", p, tidx), err.Error())
+			}
+		}
+
+		if prod.Completeness != nil {
+			sets := map[string][]string{
+				"container": prod.Completeness.Container,
+				"vm":        prod.Completeness.Vm,
+			}
+			for _, set := range []string{"container", "vm"} {
+				for tidx, t := range sets[set] {
+					if !itemTypes[t] {
+						v.add(nodeAt(root, "products", idx, "completeness", set, tidx),
+							fmt.Sprintf("%s.completeness.%s[%d]", p, set, tidx),
+							fmt.Sprintf("Unknown item type %s", t))
+					}
+				}
+			}
+		}
+
+		if prod.SupportEOL != "" {
+			if _, err := tools.ParseDate(prod.SupportEOL); err != nil {
+				v.add(nodeAt(root, "products", idx, "support_eol"), p+".support_eol",
+					err.Error())
+			}
+			if prod.Expiry != "" {
+				v.add(nodeAt(root, "products", idx, "expiry"), p+".expiry",
+					"Use support_eol or expiry, not both")
+			}
+		}
+		if prod.Expiry != "" {
+			if _, err := tools.ParseExpiry(prod.Expiry); err != nil {
+				v.add(nodeAt(root, "products", idx, "expiry"), p+".expiry",
+					err.Error())
+			}
+		}
+
+		if prod.Schedule != "" {
+			if _, err := tools.ParseCron(prod.Schedule); err != nil {
+				v.add(nodeAt(root, "products", idx, "schedule"), p+".schedule",
+					err.Error())
+			}
+			if prod.PrefixPath != "" {
+				v.add(nodeAt(root, "products", idx, "schedule"), p+".schedule",
+					"A product with prefix_path can't be scheduled")
+			}
+		}
+
+		for k := range prod.Options {
+			if k == "" || !strings.Contains(k, ".") || strings.ContainsAny(k, "= \t") {
+				v.add(nodeAt(root, "products", idx, "options", k), p+".options",
+					fmt.Sprintf("Invalid definition key %q. Use a key like image.variant", k))
+			}
+		}
+
+		if prod.Auth != nil {
+			v.checkAuth(nodeAt(root, "products", idx, "auth"), p+".auth", prod.Auth)
+		}
+
+		if v.opts.CheckFiles && prod.BuildScriptHook != "" {
+			v.checkExecutable(nodeAt(root, "products", idx, "build_script_hook"),
+				p+".build_script_hook", prod.BuildScriptHook)
+		}
+
+		if v.opts.SourceDir != "" && prod.PrefixPath == "" && prod.Directory != "" {
+			v.checkImageFile(n, p, prod)
+		}
+	}
+
+	// The aliases are checked with the alias templates expanded and the
+	// fields defined on the file. The conflicts of the fields filled from
+	// the image files are detected when the configuration is loaded.
+	products := make([]SimpleStreamsProduct, len(tree.Products))
+	for idx := range tree.Products {
+		products[idx] = tree.Products[idx]
+		products[idx].Aliases = tree.ProductAliases(&tree.Products[idx])
+	}
+	for _, c := range AliasConflicts(products) {
+		v.add(nodeAt(root, "products", c.Index, "aliases"),
+			fmt.Sprintf("products[%d].aliases", c.Index),
+			fmt.Sprintf("Duplicate alias %s for arch %s (also on product %s)",
+				c.Alias, c.Arch, c.Owner))
+	}
+}
+
+func (v *configValidator) checkAuth(n *yaml.Node, p string, a *HttpAuthConfig) {
+	switch a.Type {
+	case "", "none", "token", "bearer", "basic", "netrc":
+	default:
+		v.add(n, p+".type", fmt.Sprintf("Invalid auth type %q", a.Type))
+	}
+
+	if a.Type == "basic" && a.Username == "" {
+		v.add(n, p, "Basic auth without username")
+	}
+	if a.Type == "" && a.HasCredentials() {
+		v.add(n, p, "Missing required field type with credentials defined")
+	}
+
+	if v.opts.CheckFiles {
+		files := [][2]string{
+			{"token_file", a.TokenFile}, {"password_file", a.PasswordFile},
+			{"netrc_file", a.NetrcFile}, {"ca_bundle", a.CABundle},
+			{"client_cert", a.ClientCert}, {"client_key", a.ClientKey},
+		}
+		for _, f := range files {
+			if f[1] == "" {
+				continue
+			}
+			if _, err := os.Stat(f[1]); err != nil {
+				v.add(n, p+"."+f[0], fmt.Sprintf("File %s not found", f[1]))
+			}
+		}
+	}
+}
+
+func (v *configValidator) checkUrl(n *yaml.Node, p, value string) {
+	u, err := url.Parse(value)
+	if err != nil {
+		v.add(n, p, fmt.Sprintf("Invalid url %q: %s", value, err.Error()))
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		v.add(n, p, fmt.Sprintf("Invalid url %q: the scheme must be http or https", value))
+	} else if u.Host == "" {
+		v.add(n, p, fmt.Sprintf("Invalid url %q: missing host", value))
+	}
+}
+
+func (v *configValidator) checkExecutable(n *yaml.Node, p, file string) {
+	info, err := os.Stat(file)
+	if err != nil {
+		v.add(n, p, fmt.Sprintf("Hook script %s not found", file))
+	} else if info.IsDir() || info.Mode()&0111 == 0 {
+		v.add(n, p, fmt.Sprintf("Hook script %s is not executable", file))
+	}
+}
+
+func (v *configValidator) checkImageFile(n *yaml.Node, p string, prod *SimpleStreamsProduct) {
+	filename := v.opts.ImageFilename
+	if filename == "" {
+		filename = "image.yaml"
+	}
+
+	candidates := []string{
+		path.Join(v.opts.SourceDir, prod.Directory, filename),
+		path.Join(v.opts.SourceDir, prod.Directory, filename+".tmpl"),
+		path.Join(v.opts.SourceDir, filename),
+		path.Join(v.opts.SourceDir, filename+".tmpl"),
+	}
+	for _, f := range candidates {
+		if _, err := os.Stat(f); err == nil {
+			if prod.SupportEOL == "" && prod.Expiry == "" && !strings.HasSuffix(f, ".tmpl") {
+				v.checkImageExpiry(n, p, f)
+			}
+			return
+		}
+	}
+
+	v.add(n, p, fmt.Sprintf("Image file %s not found for product %s",
+		candidates[0], prod.Name))
+}
+
+// checkImageExpiry checks the expiry of the image file used when the
+// product doesn't define the support EOL.
+func (v *configValidator) checkImageExpiry(n *yaml.Node, p, file string) {
+	var def struct {
+		Image struct {
+			Expiry string `yaml:"expiry"`
+		} `yaml:"image"`
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		v.add(n, p, fmt.Sprintf("Error on read image file %s: %s", file, err.Error()))
+		return
+	}
+
+	// The image file could be a template: the errors are ignored.
+	if yaml.Unmarshal(data, &def) != nil || def.Image.Expiry == "" {
+		return
+	}
+
+	if _, err := tools.ParseExpiry(def.Image.Expiry); err != nil {
+		v.add(n, p, fmt.Sprintf("Image file %s: %s", file, err.Error()))
+	}
+}
+
+// nodeAt returns the node at the path or the nearest parent available.
+// The elements of the path are map keys (string) or list indexes (int).
+func nodeAt(root *yaml.Node, elems ...interface{}) *yaml.Node {
+	n := root
+	for _, e := range elems {
+		var next *yaml.Node
+
+		switch k := e.(type) {
+		case string:
+			if n.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(n.Content); i += 2 {
+					if strings.EqualFold(n.Content[i].Value, k) {
+						next = n.Content[i+1]
+						if next.Kind == yaml.ScalarNode || next.Tag == "!!null" {
+							// The key is a better position for scalars.
+							next = n.Content[i]
+						}
+						break
+					}
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && k < len(n.Content) {
+				next = n.Content[k]
+			}
+		}
+
+		if next == nil {
+			return n
+		}
+		n = next
+	}
+	return n
+}
+
+func joinPath(p, key string) string {
+	if p == "" {
+		return key
+	}
+	return p + "." + key
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// suggestKey returns a suggestion for the unknown key. It handles the
+// common typos: dash instead of underscore and singular/plural.
+func suggestKey(key string, fields map[string]reflect.Type) string {
+	candidates := []string{
+		strings.ReplaceAll(key, "-", "_"),
+		key + "s",
+		strings.TrimSuffix(key, "s"),
+		key + "es",
+	}
+	for _, c := range candidates {
+		if _, ok := fields[c]; ok && c != key {
+			return fmt.Sprintf(" (did you mean %s?)", c)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func validateTestTree(t *testing.T, content string) []ValidationProblem {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "tree.yml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := ValidateFile(file, ValidateOptions{})
+	if err != nil {
+		t.Fatalf("ValidateFile: %s", err)
+	}
+	return problems
+}
+
+func TestValidateIntegerDurationAndDuplicateProduct(t *testing.T) {
+	problems := validateTestTree(t, `
+http:
+  timeout: 60
+products:
+  - name: p1
+    directory: d1
+  - name: p1
+    directory: d1
+`)
+
+	var name, dir bool
+	for _, p := range problems {
+		switch p.Path {
+		case "products[1].name":
+			name = true
+		case "products[1].directory":
+			dir = true
+		default:
+			t.Errorf("Unexpected problem %s", p)
+		}
+	}
+	if !name || !dir {
+		t.Errorf("Expected the duplicate name and directory, got %v", problems)
+	}
+}
+
+func TestValidateDecodeFailure(t *testing.T) {
+	problems := validateTestTree(t, `
+http:
+  timeout: abc
+products:
+  - name: p1
+    directory: d1
+`)
+
+	found := false
+	for _, p := range problems {
+		if strings.Contains(p.Message, "semantic checks skipped") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the decode failure as problem, got %v", problems)
+	}
+}
@@ -0,0 +1,344 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+const (
+	AuthTypeNone   = "none"
+	AuthTypeToken  = "token"
+	AuthTypeBearer = "bearer"
+	AuthTypeBasic  = "basic"
+	AuthTypeNetrc  = "netrc"
+)
+
+// ResolveProductAuth returns the authentication settings to use with the
+// manifest of the product: the auth of the product has the precedence,
+// then the auth of the tree that match the host of the prefix_path.
+// If no auth is available, or the auth defines only the TLS settings,
+// and the global apikey is set a token auth is used.
+func ResolveProductAuth(c *config.BuilderTreeConfig, product *config.SimpleStreamsProduct) *config.HttpAuthConfig {
+	auth := product.Auth
+	if auth == nil && product.PrefixPath != "" {
+		auth = ResolveUrlAuth(c, product.PrefixPath)
+	}
+
+	if auth == nil {
+		return globalAuth(c)
+	}
+
+	if auth.Type == "" && !auth.HasCredentials() {
+		if g := globalAuth(c); g != nil {
+			// POST: the TLS settings are kept.
+			ans := *auth
+			ans.Type = g.Type
+			ans.Token = g.Token
+			return &ans
+		}
+	}
+
+	return auth
+}
+
+// ResolveUrlAuth returns the auth of the tree that match the host
+// of the url or nil.
+func ResolveUrlAuth(c *config.BuilderTreeConfig, rawUrl string) *config.HttpAuthConfig {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil
+	}
+
+	for idx := range c.Auth {
+		if matchAuthHost(c.Auth[idx].Host, u) {
+			return &c.Auth[idx]
+		}
+	}
+
+	return nil
+}
+
+// globalAuth returns a token auth with the global apikey or nil.
+func globalAuth(c *config.BuilderTreeConfig) *config.HttpAuthConfig {
+	if c.Viper != nil && c.Viper.GetString("apikey") != "" {
+		return &config.HttpAuthConfig{
+			Type:  AuthTypeToken,
+			Token: c.Viper.GetString("apikey"),
+		}
+	}
+
+	return nil
+}
+
+func matchAuthHost(pattern string, u *url.URL) bool {
+	if pattern == "" {
+		return false
+	}
+
+	if pattern == u.Host || pattern == u.Hostname() {
+		return true
+	}
+
+	if m, _ := path.Match(pattern, u.Host); m {
+		return true
+	}
+	m, _ := path.Match(pattern, u.Hostname())
+	return m
+}
+
+// ValidateAuth checks the settings and the availability of the secrets.
+func ValidateAuth(auth *config.HttpAuthConfig) error {
+	if auth == nil {
+		return nil
+	}
+
+	switch auth.Type {
+	case "":
+		if auth.HasCredentials() {
+			return fmt.Errorf("Missing auth type with credentials defined")
+		}
+	case AuthTypeNone, AuthTypeNetrc:
+	case AuthTypeToken, AuthTypeBearer:
+		if _, err := ReadSecret(auth.Token, auth.TokenFile, auth.TokenEnv); err != nil {
+			return err
+		}
+	case AuthTypeBasic:
+		if auth.Username == "" {
+			return fmt.Errorf("Basic auth without username")
+		}
+		if _, err := ReadSecret(auth.Password, auth.PasswordFile, auth.PasswordEnv); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Invalid auth type %s", auth.Type)
+	}
+
+	_, err := authTLSConfig(auth)
+	return err
+}
+
+// ReadSecret returns the secret defined inline, from a file or
+// from an environment variable.
+func ReadSecret(value, file, env string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("Error on read secret file %s: %s",
+				file, err.Error())
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	if env != "" {
+		value = os.Getenv(env)
+		if value == "" {
+			return "", fmt.Errorf("Environment variable %s is empty", env)
+		}
+		return value, nil
+	}
+
+	return "", fmt.Errorf("No secret defined")
+}
+
+func applyAuth(req *http.Request, auth *config.HttpAuthConfig) error {
+	if auth == nil {
+		return nil
+	}
+
+	switch auth.Type {
+	case "":
+		if auth.HasCredentials() {
+			return fmt.Errorf("Missing auth type with credentials defined")
+		}
+		return nil
+	case AuthTypeNone:
+		return nil
+	case AuthTypeToken:
+		token, err := ReadSecret(auth.Token, auth.TokenFile, auth.TokenEnv)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "token "+token)
+	case AuthTypeBearer:
+		token, err := ReadSecret(auth.Token, auth.TokenFile, auth.TokenEnv)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case AuthTypeBasic:
+		password, err := ReadSecret(auth.Password, auth.PasswordFile, auth.PasswordEnv)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(auth.Username, password)
+	case AuthTypeNetrc:
+		login, password, err := netrcCredentials(auth.NetrcFile, req.URL.Hostname())
+		if err != nil {
+			return err
+		}
+		if login != "" || password != "" {
+			req.SetBasicAuth(login, password)
+		}
+	default:
+		return fmt.Errorf("Invalid auth type %s", auth.Type)
+	}
+
+	return nil
+}
+
+// authTLSConfig returns the TLS config of the auth or nil
+// if the default config could be used.
+func authTLSConfig(auth *config.HttpAuthConfig) (*tls.Config, error) {
+	if auth == nil {
+		return nil, nil
+	}
+
+	if auth.CABundle == "" && auth.ClientCert == "" && !auth.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	ans := &tls.Config{
+		InsecureSkipVerify: auth.InsecureSkipVerify,
+	}
+
+	if auth.CABundle != "" {
+		pem, err := ioutil.ReadFile(auth.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("Error on read CA bundle %s: %s",
+				auth.CABundle, err.Error())
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found on CA bundle %s",
+				auth.CABundle)
+		}
+		ans.RootCAs = pool
+	}
+
+	if auth.ClientCert != "" {
+		key := auth.ClientKey
+		if key == "" {
+			// POST: the key is inside the certificate file.
+			key = auth.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(auth.ClientCert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Error on load client certificate %s: %s",
+				auth.ClientCert, err.Error())
+		}
+		ans.Certificates = []tls.Certificate{cert}
+	}
+
+	return ans, nil
+}
+
+// authKey returns the identity of the auth used to share the
+// requests of the same url with the same credentials.
+func authKey(auth *config.HttpAuthConfig) string {
+	if auth == nil {
+		return ""
+	}
+	a := *auth
+	a.Host = ""
+	return fmt.Sprintf("%+v", a)
+}
+
+// authTLSKey returns the key used to share the http clients with
+// the same TLS settings.
+func authTLSKey(auth *config.HttpAuthConfig) string {
+	if auth == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s|%s|%s|%v", auth.CABundle, auth.ClientCert,
+		auth.ClientKey, auth.InsecureSkipVerify)
+}
+
+// netrcCredentials returns the login and the password of the host
+// from the netrc file. If the file is not defined $NETRC or ~/.netrc is used.
+func netrcCredentials(file, host string) (string, string, error) {
+	var login, password string
+	var machine, defLogin, defPassword string
+	var inDefault, found bool
+
+	if file == "" {
+		file = os.Getenv("NETRC")
+	}
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		file = path.Join(home, ".netrc")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", "", fmt.Errorf("Error on read netrc file %s: %s", file, err.Error())
+	}
+
+	fields := strings.Fields(string(data))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			if found {
+				return login, password, nil
+			}
+			inDefault = false
+			if i+1 < len(fields) {
+				machine = fields[i+1]
+				found = machine == host
+				i++
+			}
+		case "default":
+			if found {
+				return login, password, nil
+			}
+			inDefault = true
+		case "login", "password":
+			if i+1 >= len(fields) {
+				break
+			}
+			value := fields[i+1]
+			if found {
+				if fields[i] == "login" {
+					login = value
+				} else {
+					password = value
+				}
+			} else if inDefault {
+				if fields[i] == "login" {
+					defLogin = value
+				} else {
+					defPassword = value
+				}
+			}
+			i++
+		}
+	}
+
+	if found {
+		return login, password, nil
+	}
+
+	return defLogin, defPassword, nil
+}
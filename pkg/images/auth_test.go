@@ -0,0 +1,74 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+func TestResolveProductAuthKeepsApikey(t *testing.T) {
+	c := config.NewBuilderTreeConfig(nil)
+	c.Viper.Set("apikey", "k3y")
+
+	p := &config.SimpleStreamsProduct{
+		PrefixPath: "https://example.com/images",
+		Auth:       &config.HttpAuthConfig{InsecureSkipVerify: true},
+	}
+
+	auth := ResolveProductAuth(c, p)
+	if auth.Type != AuthTypeToken || auth.Token != "k3y" || !auth.InsecureSkipVerify {
+		t.Errorf("Expected token auth with the TLS settings, got %+v", auth)
+	}
+	if p.Auth.Type != "" {
+		t.Error("The auth of the product is modified")
+	}
+
+	p.Auth = &config.HttpAuthConfig{Type: AuthTypeNone}
+	if auth := ResolveProductAuth(c, p); auth.Type != AuthTypeNone {
+		t.Errorf("Expected auth type none, got %+v", auth)
+	}
+}
+
+func TestValidateAuthWithoutType(t *testing.T) {
+	if err := ValidateAuth(&config.HttpAuthConfig{Token: "xxx"}); err == nil {
+		t.Error("Expected an error for credentials without type")
+	}
+	if err := ValidateAuth(&config.HttpAuthConfig{InsecureSkipVerify: true}); err != nil {
+		t.Errorf("Unexpected error for TLS settings without type: %s", err)
+	}
+}
+
+func TestFetchAllDedupByAuth(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("Authorization") != "token good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"versions": {}}`))
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t, config.HttpClientConfig{})
+	good := FetchRequest{Url: srv.URL, Auth: &config.HttpAuthConfig{Type: AuthTypeToken, Token: "good"}}
+	bad := FetchRequest{Url: srv.URL, Auth: &config.HttpAuthConfig{Type: AuthTypeToken, Token: "bad"}}
+
+	res := f.FetchAll(context.Background(), []FetchRequest{good, bad, good})
+	if calls != 2 {
+		t.Errorf("Expected 2 requests, got %d", calls)
+	}
+	if res[good.Key()] == nil || res[good.Key()].Error != nil {
+		t.Errorf("Expected a valid result for the good auth, got %+v", res[good.Key()])
+	}
+	if res[bad.Key()] == nil || res[bad.Key()].Error == nil {
+		t.Errorf("Expected an error for the bad auth, got %+v", res[bad.Key()])
+	}
+}
@@ -4,35 +4,73 @@ Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
 package images
 
 import (
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
 	streams "github.com/MottainaiCI/simplestreams-builder/pkg/simplestreams"
 )
 
+// Metadata modes of a product.
+const (
+	MetadataModeLxdOnly    = config.MetadataModeLxdOnly
+	MetadataModeIncusOnly  = config.MetadataModeIncusOnly
+	MetadataModeBridged    = config.MetadataModeBridged
+	MetadataModeNativeBoth = config.MetadataModeNativeBoth
+)
+
+// MetadataTargets returns the metadata tarballs to build for the mode.
+func MetadataTargets(mode string) (lxd, incus bool) {
+	switch mode {
+	case MetadataModeIncusOnly:
+		return false, true
+	case MetadataModeNativeBoth:
+		return true, true
+	}
+	return true, false
+}
+
 // In order to have a Simplestreams file working with LXD and Incus together
 // we need translate ftype "lxd.tar.xz" as "incus.tar.xz" or viceversa.
 // This will work until both files will be compliants.
+// The input map is not modified.
 func BridgeIncusLXDVersionsItems(omap map[string]streams.ProductVersion) map[string]streams.ProductVersion {
-	ans := make(map[string]streams.ProductVersion, 0)
+	return VersionsItemsForMode(omap, MetadataModeBridged)
+}
+
+// VersionsItemsForMode returns a copy of the versions with the metadata
+// items published by the metadata mode of the product.
+func VersionsItemsForMode(omap map[string]streams.ProductVersion, mode string) map[string]streams.ProductVersion {
+	ans := make(map[string]streams.ProductVersion, len(omap))
 
 	for k, v := range omap {
-		items := v.Items
+		items := make(map[string]streams.ProductVersionItem, len(v.Items)+1)
+		for name, item := range v.Items {
+			items[name] = item
+		}
 
-		pviLxd, hasLxd := v.Items["lxd.tar.xz"]
-		pviIncus, hasIncus := v.Items["incus.tar.xz"]
+		pviLxd, hasLxd := items["lxd.tar.xz"]
+		pviIncus, hasIncus := items["incus.tar.xz"]
 
-		if hasLxd && !hasIncus {
-			pviIncus = pviLxd
-			pviIncus.FileType = "incus.tar.xz"
-			items["incus.tar.xz"] = pviIncus
+		switch mode {
+		case MetadataModeLxdOnly:
+			delete(items, "incus.tar.xz")
+		case MetadataModeIncusOnly:
+			delete(items, "lxd.tar.xz")
+		case MetadataModeNativeBoth:
+			// POST: both items are built natively.
+		default:
+			if hasLxd && !hasIncus {
+				pviIncus = pviLxd
+				pviIncus.FileType = "incus.tar.xz"
+				items["incus.tar.xz"] = pviIncus
 
-		} else if hasIncus && !hasLxd {
-			pviLxd = pviIncus
-			pviLxd.FileType = "lxd.tar.xz"
-			items["lxd.tar.xz"] = pviLxd
+			} else if hasIncus && !hasLxd {
+				pviLxd = pviIncus
+				pviLxd.FileType = "lxd.tar.xz"
+				items["lxd.tar.xz"] = pviLxd
+			}
 		}
 
 		v.Items = items
 		ans[k] = v
-
 	}
 
 	return ans
@@ -0,0 +1,194 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+)
+
+// DefinitionFilename is the name of the image file used to complete
+// the products.
+const DefinitionFilename = "image.yaml"
+
+// lxdArchitectures maps the architecture names used by distrobuilder
+// and by the kernel to the names used by LXD.
+var lxdArchitectures = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"i386":    "i386",
+	"i586":    "i386",
+	"i686":    "i386",
+	"x86":     "i386",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv7l":  "armhf",
+	"armv7":   "armhf",
+	"armhf":   "armhf",
+	"armv6l":  "armel",
+	"armel":   "armel",
+	"ppc64le": "ppc64el",
+	"ppc64el": "ppc64el",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+var imageFieldRegex = regexp.MustCompile(`\{\{\s*image\.([a-z_]+)\s*\}\}`)
+
+// LxdArchitecture returns the name of the architecture used by LXD.
+// The unknown architectures are returned unchanged.
+func LxdArchitecture(arch string) string {
+	if ans, ok := lxdArchitectures[strings.ToLower(arch)]; ok {
+		return ans
+	}
+	return arch
+}
+
+// CompleteProducts fills the fields os, release, arch, variant and
+// release_title not defined on the products with the values of the
+// image file available under the product directory. When a field
+// defined on the product is different from the image file a warning
+// is written.
+func CompleteProducts(c *config.BuilderTreeConfig) {
+	var def *Definition
+	var err error
+	dir := definitionsDir(c)
+
+	for idx := range c.Products {
+		product := &c.Products[idx]
+		imageFile := FindDefinitionFile(dir, product.Directory, DefinitionFilename)
+		if imageFile == "" {
+			logger.Debugf("No image file %s for product %s under %s.",
+				DefinitionFilename, product.Name, dir)
+			continue
+		}
+
+		if IsDefinitionTemplate(imageFile) {
+			// POST: the template is rendered with the fields
+			// defined on tree.yml.
+			def, err = ReadImageTemplate(product, c.Values, imageFile)
+		} else {
+			def, err = ReadImageFile(imageFile, "")
+		}
+		if err != nil {
+			logger.Warningf("Error on read image file %s of product %s: %s",
+				imageFile, product.Name, err.Error())
+			continue
+		}
+
+		CompleteProduct(product, def, imageFile)
+	}
+}
+
+// CompleteProduct fills the fields of the product not defined with
+// the values of the definition.
+func CompleteProduct(product *config.SimpleStreamsProduct, def *Definition, imageFile string) {
+	image := def.Image
+
+	completeField(product, imageFile, "os", &product.OperatingSystem,
+		image.Distribution, strings.EqualFold)
+	completeField(product, imageFile, "release", &product.Release,
+		image.Release, nil)
+	completeField(product, imageFile, "arch", &product.Architecture,
+		LxdArchitecture(image.Architecture), func(a, b string) bool {
+			return LxdArchitecture(a) == LxdArchitecture(b)
+		})
+	completeField(product, imageFile, "variant", &product.Variant,
+		image.Variant, nil)
+
+	// The description could contain the expressions of distrobuilder.
+	description := imageFieldRegex.ReplaceAllStringFunc(image.Description, func(s string) string {
+		switch imageFieldRegex.FindStringSubmatch(s)[1] {
+		case "distribution":
+			return image.Distribution
+		case "release":
+			return image.Release
+		case "architecture":
+			return image.Architecture
+		case "variant":
+			return image.Variant
+		case "serial":
+			return image.Serial
+		}
+		return s
+	})
+	if strings.Contains(description, "{{") || strings.Contains(description, "{%") {
+		logger.Debugf("Ignoring description %q of image file %s.", image.Description, imageFile)
+		description = ""
+	}
+	completeField(product, imageFile, "release_title", &product.ReleaseTitle,
+		description, nil)
+}
+
+func completeField(product *config.SimpleStreamsProduct, imageFile, name string,
+	field *string, value string, equal func(a, b string) bool) {
+	if value == "" {
+		return
+	}
+
+	if *field == "" {
+		*field = value
+		logger.Debugf("For product %s use %s %s from image file %s.",
+			product.Name, name, value, imageFile)
+		return
+	}
+
+	if equal == nil {
+		equal = func(a, b string) bool { return a == b }
+	}
+	if !equal(*field, value) {
+		logger.Warningf("For product %s the %s %s is different from %s of image file %s.",
+			product.Name, name, *field, value, imageFile)
+	}
+}
+
+// FindDefinitionFile returns the path of the image file of a product
+// or an empty string. The file is searched under the product directory
+// and then under the directory dir. If the file is not available, the
+// template of the file (with suffix .tmpl) is searched too.
+func FindDefinitionFile(dir, productDir, filename string) string {
+	dirs := []string{
+		strings.TrimRight(path.Join(dir, productDir), "/"),
+		strings.TrimRight(dir, "/"),
+	}
+
+	for _, d := range dirs {
+		imageFile := fmt.Sprintf("%s/%s", d, filename)
+		if _, err := os.Stat(imageFile); err == nil {
+			return imageFile
+		}
+
+		if !IsDefinitionTemplate(filename) {
+			tmplFile := imageFile + DefinitionTemplateSuffix
+			if _, err := os.Stat(tmplFile); err == nil {
+				return tmplFile
+			}
+		}
+	}
+
+	return ""
+}
+
+func definitionsDir(c *config.BuilderTreeConfig) string {
+	var base string = "."
+
+	if c.Viper != nil && c.Viper.ConfigFileUsed() != "" {
+		base = filepath.Dir(c.Viper.ConfigFileUsed())
+	}
+
+	if c.DefinitionsDir == "" {
+		return base
+	}
+	if filepath.IsAbs(c.DefinitionsDir) {
+		return c.DefinitionsDir
+	}
+	return filepath.Join(base, c.DefinitionsDir)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"fmt"
+	"strings"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	streams "github.com/MottainaiCI/simplestreams-builder/pkg/simplestreams"
+)
+
+// bridgedItems contains the metadata items that are published also
+// with the name of the other item on the bridged mode.
+var bridgedItems = map[string]string{
+	config.ItemTypeLxdTarXz:   config.ItemTypeIncusTarXz,
+	config.ItemTypeIncusTarXz: config.ItemTypeLxdTarXz,
+}
+
+// CheckVersionComplete returns an error with the missing items if the
+// version can't be published. Without completeness rules a version
+// requires a metadata item and a rootfs item.
+func CheckVersionComplete(product *config.SimpleStreamsProduct, types []*ItemType,
+	items map[string]streams.ProductVersionItem) error {
+	rules := product.Completeness
+
+	if rules == nil || (len(rules.Container) == 0 && len(rules.Vm) == 0) {
+		var hasMetadata, hasRootfs bool
+
+		for _, t := range types {
+			if _, ok := items[t.Name]; !ok {
+				continue
+			}
+			if t.Kind == ItemKindMetadata {
+				hasMetadata = true
+			} else {
+				hasRootfs = true
+			}
+		}
+
+		missing := []string{}
+		if !hasMetadata {
+			missing = append(missing, "metadata item")
+		}
+		if !hasRootfs {
+			missing = append(missing, "rootfs item")
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing %s", strings.Join(missing, " and "))
+		}
+		return nil
+	}
+
+	reasons := []string{}
+	for _, set := range []struct {
+		name  string
+		items []string
+	}{
+		{"container", rules.Container},
+		{"vm", rules.Vm},
+	} {
+		if len(set.items) == 0 {
+			continue
+		}
+
+		missing := missingItems(set.items, items, product.MetadataMode)
+		if len(missing) == 0 {
+			return nil
+		}
+		reasons = append(reasons, fmt.Sprintf("missing %s for %s",
+			strings.Join(missing, ", "), set.name))
+	}
+
+	return fmt.Errorf("%s", strings.Join(reasons, "; "))
+}
+
+func missingItems(required []string, items map[string]streams.ProductVersionItem, mode string) []string {
+	ans := []string{}
+
+	for _, name := range required {
+		if _, ok := items[name]; ok {
+			continue
+		}
+		if mode != "" && mode != MetadataModeBridged {
+			ans = append(ans, name)
+			continue
+		}
+		if bridged, ok := bridgedItems[name]; ok {
+			if _, ok := items[bridged]; ok {
+				continue
+			}
+		}
+		ans = append(ans, name)
+	}
+
+	return ans
+}
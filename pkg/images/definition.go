@@ -23,9 +23,9 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package images
 
 import (
-	"regexp"
-	"strconv"
 	"time"
+
+	tools "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
 )
 
 // Code imported by distrobuilder project and avoid injection of the project
@@ -236,36 +236,13 @@ type Definition struct {
 	Environment DefinitionEnv      `yaml:"environment,omitempty"`
 }
 
-//GetExpiryDate returns an expiry date based on the creationDate and format.
+// GetExpiryDate returns an expiry date based on the creationDate and format.
+// If the format is not valid the creationDate is returned. Use
+// tools.ExpiryDate to retrieve the error.
 func GetExpiryDate(creationDate time.Time, format string) time.Time {
-	regex := regexp.MustCompile(`(?:(\d+)(s|m|h|d|w))*`)
-	expiryDate := creationDate
-
-	for _, match := range regex.FindAllStringSubmatch(format, -1) {
-		// Ignore empty matches
-		if match[0] == "" {
-			continue
-		}
-
-		var duration time.Duration
-
-		switch match[2] {
-		case "s":
-			duration = time.Second
-		case "m":
-			duration = time.Minute
-		case "h":
-			duration = time.Hour
-		case "d":
-			duration = 24 * time.Hour
-		case "w":
-			duration = 7 * 24 * time.Hour
-		}
-
-		// Ignore any error since it will be an integer.
-		value, _ := strconv.Atoi(match[1])
-		expiryDate = expiryDate.Add(time.Duration(value) * duration)
+	ans, err := tools.ExpiryDate(creationDate, format)
+	if err != nil {
+		return creationDate
 	}
-
-	return expiryDate
+	return ans
 }
@@ -0,0 +1,342 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	streams "github.com/MottainaiCI/simplestreams-builder/pkg/simplestreams"
+)
+
+const (
+	DiffStatusAdded   = "added"
+	DiffStatusRemoved = "removed"
+	DiffStatusChanged = "changed"
+)
+
+// ItemChange describes a field of an item changed for the same
+// version. A change of hash or size of a published version is
+// a red flag: the clients could have cached the old file.
+type ItemChange struct {
+	Version string `json:"version"`
+	Item    string `json:"item"`
+	Field   string `json:"field"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+}
+
+// ProductDiff contains the differences of a product between
+// two images.json files.
+type ProductDiff struct {
+	Name string `json:"name"`
+	// Status is added, removed or changed.
+	Status  string       `json:"status"`
+	Added   []string     `json:"added_versions"`
+	Removed []string     `json:"removed_versions"`
+	Items   []ItemChange `json:"changed_items,omitempty"`
+
+	OldAliases string `json:"old_aliases,omitempty"`
+	NewAliases string `json:"new_aliases,omitempty"`
+	OldEOL     string `json:"old_support_eol,omitempty"`
+	NewEOL     string `json:"new_support_eol,omitempty"`
+}
+
+// ImagesDiff contains the differences between two images.json files.
+type ImagesDiff struct {
+	Old      string        `json:"old"`
+	New      string        `json:"new"`
+	Products []ProductDiff `json:"products"`
+}
+
+// VersionsChanged returns true if versions are added or removed.
+func (d *ProductDiff) VersionsChanged() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0
+}
+
+func (d *ProductDiff) AliasesChanged() bool {
+	return d.OldAliases != d.NewAliases
+}
+
+func (d *ProductDiff) EOLChanged() bool {
+	return d.OldEOL != d.NewEOL
+}
+
+func (d *ProductDiff) Changed() bool {
+	return d.Status != DiffStatusChanged || d.VersionsChanged() ||
+		len(d.Items) > 0 || d.AliasesChanged() || d.EOLChanged()
+}
+
+func (d *ImagesDiff) Changed() bool {
+	return len(d.Products) > 0
+}
+
+// ItemsChanged returns true if an item of a version already
+// published has been modified.
+func (d *ImagesDiff) ItemsChanged() bool {
+	for _, p := range d.Products {
+		if len(p.Items) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffImages compares two images.json structs. A nil struct is
+// considered empty.
+func DiffImages(oldImgs, newImgs *streams.Products) *ImagesDiff {
+	ans := &ImagesDiff{Products: []ProductDiff{}}
+	names := map[string]bool{}
+
+	oldProducts := map[string]streams.Product{}
+	newProducts := map[string]streams.Product{}
+	if oldImgs != nil && oldImgs.Products != nil {
+		oldProducts = oldImgs.Products
+	}
+	if newImgs != nil && newImgs.Products != nil {
+		newProducts = newImgs.Products
+	}
+
+	for name := range oldProducts {
+		names[name] = true
+	}
+	for name := range newProducts {
+		names[name] = true
+	}
+
+	for name := range names {
+		oldP, inOld := oldProducts[name]
+		newP, inNew := newProducts[name]
+
+		d := ProductDiff{
+			Name:    name,
+			Status:  DiffStatusChanged,
+			Added:   []string{},
+			Removed: []string{},
+		}
+
+		if !inOld {
+			d.Status = DiffStatusAdded
+		} else if !inNew {
+			d.Status = DiffStatusRemoved
+		} else {
+			d.OldAliases, d.NewAliases = oldP.Aliases, newP.Aliases
+			d.OldEOL, d.NewEOL = oldP.SupportedEOL, newP.SupportedEOL
+			if !d.AliasesChanged() {
+				d.OldAliases, d.NewAliases = "", ""
+			}
+			if !d.EOLChanged() {
+				d.OldEOL, d.NewEOL = "", ""
+			}
+		}
+
+		for v, newV := range newP.Versions {
+			oldV, ok := oldP.Versions[v]
+			if !ok {
+				d.Added = append(d.Added, v)
+				continue
+			}
+			d.Items = append(d.Items, diffVersionItems(v, oldV, newV)...)
+		}
+		for v := range oldP.Versions {
+			if _, ok := newP.Versions[v]; !ok {
+				d.Removed = append(d.Removed, v)
+			}
+		}
+
+		if d.Changed() {
+			sort.Strings(d.Added)
+			sort.Strings(d.Removed)
+			sort.Slice(d.Items, func(i, j int) bool {
+				a, b := d.Items[i], d.Items[j]
+				if a.Version != b.Version {
+					return a.Version < b.Version
+				}
+				if a.Item != b.Item {
+					return a.Item < b.Item
+				}
+				return a.Field < b.Field
+			})
+			ans.Products = append(ans.Products, d)
+		}
+	}
+
+	sort.Slice(ans.Products, func(i, j int) bool {
+		return ans.Products[i].Name < ans.Products[j].Name
+	})
+
+	return ans
+}
+
+func diffVersionItems(version string, oldV, newV streams.ProductVersion) []ItemChange {
+	ans := []ItemChange{}
+
+	for name, newI := range newV.Items {
+		oldI, ok := oldV.Items[name]
+		if !ok {
+			ans = append(ans, ItemChange{
+				Version: version, Item: name, Field: "item",
+				New: newI.Path,
+			})
+			continue
+		}
+
+		fields := [][3]string{
+			{"sha256", oldI.HashSha256, newI.HashSha256},
+			{"md5", oldI.HashMd5, newI.HashMd5},
+			{"size", fmt.Sprintf("%d", oldI.Size), fmt.Sprintf("%d", newI.Size)},
+			{"path", oldI.Path, newI.Path},
+			{"ftype", oldI.FileType, newI.FileType},
+			{"combined_sha256", oldI.CombinedHashSha256, newI.CombinedHashSha256},
+			{"combined_rootxz_sha256", oldI.CombinedHashSha256RootXz, newI.CombinedHashSha256RootXz},
+			{"combined_squashfs_sha256", oldI.CombinedHashSha256SquashFs, newI.CombinedHashSha256SquashFs},
+			{"combined_disk-kvm-img_sha256", oldI.CombinedHashSha256DiskKvmImg, newI.CombinedHashSha256DiskKvmImg},
+			{"combined_disk1-img_sha256", oldI.CombinedHashSha256DiskImg, newI.CombinedHashSha256DiskImg},
+			{"combined_uefi1-img_sha256", oldI.CombinedHashSha256DiskUefiImg, newI.CombinedHashSha256DiskUefiImg},
+		}
+		for _, f := range fields {
+			if f[1] != f[2] {
+				ans = append(ans, ItemChange{
+					Version: version, Item: name, Field: f[0],
+					Old: f[1], New: f[2],
+				})
+			}
+		}
+	}
+
+	for name, oldI := range oldV.Items {
+		if _, ok := newV.Items[name]; !ok {
+			ans = append(ans, ItemChange{
+				Version: version, Item: name, Field: "item",
+				Old: oldI.Path,
+			})
+		}
+	}
+
+	return ans
+}
+
+// DiffProductsVersions returns the products with versions added or
+// removed. A nil images struct is considered empty.
+func DiffProductsVersions(oldImgs, newImgs *streams.Products) []ProductDiff {
+	ans := []ProductDiff{}
+	for _, d := range DiffImages(oldImgs, newImgs).Products {
+		if d.VersionsChanged() {
+			ans = append(ans, d)
+		}
+	}
+	return ans
+}
+
+// LoadImagesJson reads the images.json from a file, from an url or
+// from the streams/v1 directory of a tree.
+func LoadImagesJson(ctx context.Context, c *config.BuilderTreeConfig, source string) (*streams.Products, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		fetcher, err := NewManifestFetcher(c.Http)
+		if err != nil {
+			return nil, err
+		}
+
+		auth := ResolveUrlAuth(c, source)
+		if auth == nil {
+			auth = globalAuth(c)
+		}
+
+		data, err := fetcher.FetchData(ctx, source, auth)
+		if err != nil {
+			return nil, err
+		}
+
+		ans := &streams.Products{}
+		err = json.Unmarshal(data, ans)
+		if err != nil {
+			return nil, fmt.Errorf("Error on parse %s: %s", source, err.Error())
+		}
+		return ans, nil
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		source = path.Join(source, "streams/v1/images.json")
+	}
+
+	return ReadImagesJson(source)
+}
+
+func WriteImagesDiffJson(d *ImagesDiff, out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// WriteImagesDiffText writes the differences in human-readable format.
+// The changes of hash or size of a published version are marked with !.
+func WriteImagesDiffText(d *ImagesDiff, out io.Writer) error {
+	var b strings.Builder
+	var added, removed, changed, items int
+
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", d.Old, d.New)
+
+	for _, p := range d.Products {
+		switch p.Status {
+		case DiffStatusAdded:
+			added++
+			fmt.Fprintf(&b, "+ product %s\n", p.Name)
+		case DiffStatusRemoved:
+			removed++
+			fmt.Fprintf(&b, "- product %s\n", p.Name)
+		default:
+			changed++
+			fmt.Fprintf(&b, "~ product %s\n", p.Name)
+		}
+
+		for _, v := range p.Added {
+			fmt.Fprintf(&b, "    + version %s\n", v)
+		}
+		for _, v := range p.Removed {
+			fmt.Fprintf(&b, "    - version %s\n", v)
+		}
+		for _, i := range p.Items {
+			items++
+			fmt.Fprintf(&b, "    ! version %s item %s %s: %s -> %s\n",
+				i.Version, i.Item, i.Field, diffValue(i.Old), diffValue(i.New))
+		}
+		if p.AliasesChanged() {
+			fmt.Fprintf(&b, "    ~ aliases: %s -> %s\n",
+				diffValue(p.OldAliases), diffValue(p.NewAliases))
+		}
+		if p.EOLChanged() {
+			fmt.Fprintf(&b, "    ~ support_eol: %s -> %s\n",
+				diffValue(p.OldEOL), diffValue(p.NewEOL))
+		}
+	}
+
+	if !d.Changed() {
+		b.WriteString("No changes.\n")
+	} else {
+		fmt.Fprintf(&b,
+			"\n%d products added, %d removed, %d changed, %d items changed on published versions.\n",
+			added, removed, changed, items)
+	}
+
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func diffValue(v string) string {
+	if v == "" {
+		return "<none>"
+	}
+	return v
+}
@@ -0,0 +1,438 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+)
+
+// ManifestFetcher retrieves the ssb.json files of the products exposed
+// over HTTP with retries, exponential backoff and conditional requests.
+type ManifestFetcher struct {
+	Settings config.HttpClientConfig
+
+	proxy   func(*http.Request) (*url.URL, error)
+	mutex   sync.Mutex
+	clients map[string]*http.Client
+}
+
+// FetchRequest contains the url of a remote manifest and the
+// authentication settings to use.
+type FetchRequest struct {
+	Url  string
+	Auth *config.HttpAuthConfig
+}
+
+// Key returns the key of the result of the request. The requests of the
+// same url are shared only if they use the same auth.
+func (r FetchRequest) Key() string {
+	return r.Url + "|" + authKey(r.Auth)
+}
+
+// FetchResult contains the result of the fetch of a remote manifest.
+type FetchResult struct {
+	Url      string
+	Manifest *VersionsSSBuilderManifest
+	Error    error
+}
+
+type fetchCacheMeta struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+type fetchStatusError struct {
+	StatusCode int
+	Url        string
+}
+
+func (e *fetchStatusError) Error() string {
+	return fmt.Sprintf("Invalid response %d for url %s", e.StatusCode, e.Url)
+}
+
+func NewManifestFetcher(settings config.HttpClientConfig) (*ManifestFetcher, error) {
+	var err error
+	ans := &ManifestFetcher{
+		clients: make(map[string]*http.Client, 0),
+	}
+
+	ans.proxy, err = httpProxy(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	if os.Getenv("SSBUILDER_INSECURE_SKIPVERIFY") != "" {
+		logger.Warning("SSBUILDER_INSECURE_SKIPVERIFY is not supported anymore. " +
+			"Use the insecure_skipverify option of the auth settings.")
+	}
+
+	// The environment variable is maintained for backward compatibility.
+	httpTimeout := os.Getenv("SSBUILDER_HTTP_TIMEOUT")
+	if httpTimeout != "" {
+		t, err := strconv.Atoi(httpTimeout)
+		if err == nil {
+			logger.Debugf("SSBUILDER_HTTP_TIMEOUT available. Using %s", httpTimeout)
+			settings.Timeout = time.Duration(t) * time.Second
+		} else {
+			logger.Warningf(
+				"SSBUILDER_HTTP_TIMEOUT available. Ignoring wrong value %s",
+				httpTimeout)
+		}
+	}
+
+	if settings.Timeout <= 0 {
+		settings.Timeout = 60 * time.Second
+	}
+	if settings.Concurrency <= 0 {
+		settings.Concurrency = 1
+	}
+
+	ans.Settings = settings
+
+	return ans, nil
+}
+
+// client returns the http client with the TLS settings of the auth.
+func (f *ManifestFetcher) client(auth *config.HttpAuthConfig) (*http.Client, error) {
+	key := authTLSKey(auth)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if c, ok := f.clients[key]; ok {
+		return c, nil
+	}
+
+	c, err := newHttpClient(f.proxy, f.Settings.Timeout, auth)
+	if err != nil {
+		return nil, err
+	}
+	f.clients[key] = c
+
+	return c, nil
+}
+
+// NewHttpClient returns an http client with the proxy and the timeout
+// of the settings and the TLS settings of the auth.
+func NewHttpClient(settings config.HttpClientConfig, auth *config.HttpAuthConfig) (*http.Client, error) {
+	proxy, err := httpProxy(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHttpClient(proxy, settings.Timeout, auth)
+}
+
+func newHttpClient(proxy func(*http.Request) (*url.URL, error), timeout time.Duration, auth *config.HttpAuthConfig) (*http.Client, error) {
+	tlsConfig, err := authTLSConfig(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil && tlsConfig.InsecureSkipVerify {
+		logger.Warning("TLS verification disabled by auth settings. You know what you do.")
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           proxy,
+			MaxIdleConns:    5,
+			IdleConnTimeout: 30 * time.Second,
+			TLSClientConfig: tlsConfig,
+		},
+		Timeout: timeout,
+	}, nil
+}
+
+// httpProxy returns the proxy of the settings or, if not defined,
+// the proxy of the environment (HTTP_PROXY/HTTPS_PROXY).
+func httpProxy(settings config.HttpClientConfig) (func(*http.Request) (*url.URL, error), error) {
+	if settings.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyUrl, err := url.Parse(settings.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid http proxy %s: %s",
+			settings.Proxy, err.Error())
+	}
+
+	return http.ProxyURL(proxyUrl), nil
+}
+
+// Fetch retrieves and parses the remote manifest. Transient errors
+// (timeouts, connection errors, 429 and 5xx responses) are retried.
+func (f *ManifestFetcher) Fetch(ctx context.Context, url string, auth *config.HttpAuthConfig) (*VersionsSSBuilderManifest, error) {
+	data, err := f.FetchData(ctx, url, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	ans := &VersionsSSBuilderManifest{}
+	err = json.Unmarshal(data, ans)
+	if err != nil {
+		return nil, err
+	}
+
+	return ans, nil
+}
+
+// FetchData retrieves the content of the url with the retries and
+// the cache of the fetcher.
+func (f *ManifestFetcher) FetchData(ctx context.Context, url string, auth *config.HttpAuthConfig) ([]byte, error) {
+	var data []byte
+	var err error
+
+	for attempt := 0; attempt <= f.Settings.Retries; attempt++ {
+		if attempt > 0 {
+			wait := f.backoff(attempt)
+			logger.Warningf("Retry %d/%d of url %s in %s: %s",
+				attempt, f.Settings.Retries, url, wait, err.Error())
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		data, err = f.get(ctx, url, auth)
+		if err == nil || ctx.Err() != nil || !isTransientError(err) {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// FetchAll retrieves the manifests of the requests in input using
+// a number of concurrent requests defined by the settings. The results
+// are indexed by the key of the requests.
+func (f *ManifestFetcher) FetchAll(ctx context.Context, requests []FetchRequest) map[string]*FetchResult {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	ans := make(map[string]*FetchResult, 0)
+	sem := make(chan struct{}, f.Settings.Concurrency)
+
+	for _, r := range requests {
+		key := r.Key()
+		if _, ok := ans[key]; ok {
+			continue
+		}
+		ans[key] = nil
+
+		wg.Add(1)
+		go func(r FetchRequest) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			manifest, err := f.Fetch(ctx, r.Url, r.Auth)
+
+			mutex.Lock()
+			ans[r.Key()] = &FetchResult{Url: r.Url, Manifest: manifest, Error: err}
+			mutex.Unlock()
+		}(r)
+	}
+
+	wg.Wait()
+
+	return ans
+}
+
+func (f *ManifestFetcher) backoff(attempt int) time.Duration {
+	ans := f.Settings.Backoff
+	if ans <= 0 {
+		return 0
+	}
+
+	for i := 1; i < attempt; i++ {
+		ans = ans * 2
+		if f.Settings.MaxBackoff > 0 && ans >= f.Settings.MaxBackoff {
+			return f.Settings.MaxBackoff
+		}
+	}
+
+	return ans
+}
+
+func (f *ManifestFetcher) get(ctx context.Context, url string, auth *config.HttpAuthConfig) ([]byte, error) {
+	var meta *fetchCacheMeta
+	var cacheFile, cacheMetaFile string
+
+	client, err := f.client(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = applyAuth(req, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Settings.CacheDir != "" {
+		cacheFile, cacheMetaFile = f.cachePaths(url)
+		meta = readFetchCacheMeta(cacheMetaFile)
+		if meta != nil {
+			if meta.ETag != "" {
+				req.Header.Set("If-None-Match", meta.ETag)
+			}
+			if meta.LastModified != "" {
+				req.Header.Set("If-Modified-Since", meta.LastModified)
+			}
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && meta != nil {
+		data, err := ioutil.ReadFile(cacheFile)
+		if err == nil {
+			logger.Debugf("Url %s not modified. Using cached file.", url)
+			return data, nil
+		}
+		// POST: cache file corrupted. I retry without conditional headers.
+		os.Remove(cacheMetaFile)
+		return f.get(ctx, url, auth)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &fetchStatusError{StatusCode: resp.StatusCode, Url: url}
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Settings.CacheDir != "" {
+		err = f.writeCache(url, data, &fetchCacheMeta{
+			Url:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		})
+		if err != nil {
+			logger.Warningf("Error on write cache of the url %s: %s", url, err.Error())
+		}
+	}
+
+	return data, nil
+}
+
+func (f *ManifestFetcher) cachePaths(url string) (string, string) {
+	h := sha256.Sum256([]byte(url))
+	name := hex.EncodeToString(h[:])
+	return path.Join(f.Settings.CacheDir, name+".json"),
+		path.Join(f.Settings.CacheDir, name+".meta")
+}
+
+func (f *ManifestFetcher) writeCache(url string, data []byte, meta *fetchCacheMeta) error {
+	cacheFile, cacheMetaFile := f.cachePaths(url)
+
+	if meta.ETag == "" && meta.LastModified == "" {
+		// POST: conditional requests are not possible.
+		return nil
+	}
+
+	err := os.MkdirAll(f.Settings.CacheDir, 0760)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(cacheFile, data, 0660)
+	if err != nil {
+		return err
+	}
+
+	mdata, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(cacheMetaFile, mdata, 0660)
+}
+
+func readFetchCacheMeta(file string) *fetchCacheMeta {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+
+	ans := &fetchCacheMeta{}
+	if json.Unmarshal(data, ans) != nil {
+		return nil
+	}
+
+	return ans
+}
+
+// IsTransientStatus returns true if a request with the response
+// status code in input could be retried: 429 and 5xx.
+func IsTransientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+func isTransientError(err error) bool {
+	if serr, ok := err.(*fetchStatusError); ok {
+		return IsTransientStatus(serr.StatusCode)
+	}
+	return IsTransientNetworkError(err)
+}
+
+// IsTransientNetworkError returns true for the timeouts and the
+// connections refused, reset or closed. The other errors, for example
+// the certificate errors or the invalid urls, are not retried.
+func IsTransientNetworkError(err error) bool {
+	var nerr net.Error
+
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// ProductManifestUrl returns the url of the ssb.json of a remote product.
+func ProductManifestUrl(product *config.SimpleStreamsProduct) string {
+	return fmt.Sprintf("%s/%s/ssb.json",
+		strings.TrimRight(product.PrefixPath, "/"),
+		strings.TrimRight(product.Directory, "/"),
+	)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+func newTestFetcher(t *testing.T, settings config.HttpClientConfig) *ManifestFetcher {
+	t.Helper()
+	f, err := NewManifestFetcher(settings)
+	if err != nil {
+		t.Fatalf("NewManifestFetcher: %s", err)
+	}
+	return f
+}
+
+func TestFetchRetriesTransientErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte(`{"versions": {}}`))
+		}
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t, config.HttpClientConfig{
+		Retries: 3,
+		Backoff: time.Millisecond,
+	})
+	_, err := f.Fetch(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 requests, got %d", calls)
+	}
+}
+
+func TestFetchNoRetryOnClientErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t, config.HttpClientConfig{
+		Retries: 3,
+		Backoff: time.Millisecond,
+	})
+	_, err := f.Fetch(context.Background(), srv.URL, nil)
+	if err == nil {
+		t.Fatal("Expected an error on 404")
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 request, got %d", calls)
+	}
+}
+
+func TestFetchRetriesExhausted(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t, config.HttpClientConfig{
+		Retries: 2,
+		Backoff: time.Millisecond,
+	})
+	_, err := f.Fetch(context.Background(), srv.URL, nil)
+	if err == nil {
+		t.Fatal("Expected an error on 502")
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 requests, got %d", calls)
+	}
+}
+
+func TestFetchBackoff(t *testing.T) {
+	f := newTestFetcher(t, config.HttpClientConfig{
+		Backoff:    time.Second,
+		MaxBackoff: 5 * time.Second,
+	})
+
+	expected := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	}
+	for idx, e := range expected {
+		if b := f.backoff(idx + 1); b != e {
+			t.Errorf("Attempt %d: expected backoff %s, got %s", idx+1, e, b)
+		}
+	}
+
+	f.Settings.Backoff = 0
+	if b := f.backoff(3); b != 0 {
+		t.Errorf("Expected no backoff, got %s", b)
+	}
+}
+
+func TestFetchETagCache(t *testing.T) {
+	var calls, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"versions": {}}`))
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t, config.HttpClientConfig{
+		CacheDir: t.TempDir(),
+	})
+
+	first, err := f.FetchData(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatalf("First FetchData: %s", err)
+	}
+	second, err := f.FetchData(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatalf("Second FetchData: %s", err)
+	}
+
+	if calls != 2 || notModified != 1 {
+		t.Errorf("Expected 2 requests and 1 conditional, got %d and %d", calls, notModified)
+	}
+	if string(first) != string(second) {
+		t.Errorf("Cached data %q differs from %q", second, first)
+	}
+}
+
+func TestFetchRetriesConnectionErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := srv.URL
+	srv.Close()
+
+	f := newTestFetcher(t, config.HttpClientConfig{
+		Retries: 1,
+		Backoff: time.Millisecond,
+	})
+	_, err := f.FetchData(context.Background(), url, nil)
+	if err == nil {
+		t.Fatal("Expected an error with the server closed")
+	}
+	if !isTransientError(err) {
+		t.Errorf("Expected a transient error, got %s", err)
+	}
+}
+
+func TestFetchNoRetryOnCertificateErrors(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	f := newTestFetcher(t, config.HttpClientConfig{
+		Retries: 3,
+		Backoff: time.Second,
+	})
+
+	start := time.Now()
+	_, err := f.FetchData(context.Background(), srv.URL, nil)
+	if err == nil {
+		t.Fatal("Expected a certificate error")
+	}
+	if isTransientError(err) {
+		t.Errorf("Certificate error considered transient: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Certificate error retried: %s", elapsed)
+	}
+}
@@ -20,11 +20,11 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package images
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"os"
-	"path"
+	"io/ioutil"
 	"strings"
 
 	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
@@ -32,13 +32,21 @@ import (
 )
 
 func BuildImagesFile(config *config.BuilderTreeConfig, sourceDir string) (*streams.Products, error) {
+	snapshot, err := NewManifestLoader(config, sourceDir).Load(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return BuildImagesFileFromSnapshot(config, snapshot)
+}
+
+// BuildImagesFileFromSnapshot creates the images.json struct from the
+// manifests already loaded.
+func BuildImagesFileFromSnapshot(config *config.BuilderTreeConfig, snapshot *ManifestsSnapshot) (*streams.Products, error) {
 	// NOTE: currently SimpleStreamsManifest struct doesn't contain
 	//       content_id field.
-	var ssbPath string
 	var ans *streams.Products
 	var prodMap map[string]streams.Product
-	var manifest *VersionsSSBuilderManifest
-	var err error
 
 	if config.DataType == "" {
 		return nil, fmt.Errorf("Invalid datatype")
@@ -60,62 +68,17 @@ func BuildImagesFile(config *config.BuilderTreeConfig, sourceDir string) (*strea
 		Products: prodMap,
 	}
 
-	for _, v := range config.Products {
-		if v.Hidden {
-			continue
-		}
-
-		// For every product I try to retrieve ssb.json file
-		// for set versions map.
-		if v.PrefixPath != "" {
-
-			ssbPath = fmt.Sprintf("%s/%s/ssb.json",
-				strings.TrimRight(v.PrefixPath, "/"),
-				strings.TrimRight(v.Directory, "/"),
-			)
-			// Fetch and parse remote ssb.json file
-			manifest, err = ReadVersionsManifestJsonFromUrl(ssbPath, config.Viper.GetString("apikey"))
-
-		} else {
-			// POST: Try to search ssb.json file under local filesystem.
-
-			if sourceDir == "" {
-				return nil, fmt.Errorf(
-					"Product %s without prefix_path but source-dir is empty.",
-					v.Name)
-			}
-
-			ssbPath = path.Join(sourceDir, v.Directory, "/ssb.json")
-			fmt.Println("Check ssb file ", ssbPath)
-
-			if _, err := os.Stat(ssbPath); os.IsNotExist(err) {
-				// POST: Ignore product
-				fmt.Println(fmt.Sprintf("Product %s is skipped. ssb.json file not found.", v.Name))
-				continue
-			}
-
-			// Parse ssb.json file
-			manifest, err = ReadVersionsManifestJson(ssbPath)
-		}
-
-		if err != nil {
-			fmt.Println(fmt.Sprintf("Product %s is skipped. Error on parse ssb.json: %s",
-				v.Name, err.Error()))
-			continue
-		}
-
-		if manifest.Name != v.Name {
-			fmt.Println(fmt.Sprintf(
-				"Product %s is skipped. It contains invalid ssb.json file.", v.Name))
-			continue
-		}
+	for _, pm := range snapshot.Available() {
+		v := pm.Product
+		manifest := pm.Manifest
 
 		prodManifest := streams.Product{
 			Architecture:    v.Architecture,
 			OperatingSystem: v.OperatingSystem,
 			Release:         v.Release,
 			ReleaseTitle:    v.ReleaseTitle,
-			Versions:        BridgeIncusLXDVersionsItems(manifest.Versions),
+			Variant:         v.Variant,
+			Versions:        VersionsItemsForMode(manifest.Versions, v.MetadataMode),
 		}
 
 		if v.Version != "" {
@@ -141,3 +104,19 @@ func WriteImagesJson(imgs *streams.Products, out io.Writer) error {
 	enc := json.NewEncoder(out)
 	return enc.Encode(imgs)
 }
+
+// ReadImagesJson reads an images.json file.
+func ReadImagesJson(file string) (*streams.Products, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	ans := &streams.Products{}
+	err = json.Unmarshal(data, ans)
+	if err != nil {
+		return nil, err
+	}
+
+	return ans, nil
+}
@@ -0,0 +1,411 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+	streams "github.com/MottainaiCI/simplestreams-builder/pkg/simplestreams"
+)
+
+const (
+	ItemKindMetadata = config.ItemKindMetadata
+	ItemKindRootfs   = config.ItemKindRootfs
+
+	CombinedHashNone       = ""
+	CombinedHashRootXz     = "rootxz"
+	CombinedHashSquashFs   = "squashfs"
+	CombinedHashDiskKvmImg = "disk-kvm-img"
+	CombinedHashDiskImg    = "disk1-img"
+	CombinedHashUefiImg    = "uefi1-img"
+)
+
+// ItemType describes an artifact that could be present inside a
+// version directory and how it's exposed in the versions manifest.
+type ItemType struct {
+	// Name is the key of the item inside the version items map.
+	Name string
+	// Pattern is the filename (or the shell pattern) of the artifact.
+	Pattern string
+	// FileType is the ftype exposed to LXD/Incus.
+	FileType string
+	// Kind is ItemKindMetadata or ItemKindRootfs.
+	Kind string
+	// CombinedHash is the combined field of the metadata items fed
+	// by a rootfs item.
+	CombinedHash string
+	// Default is true when the item type is enabled for all products.
+	Default bool
+}
+
+// ItemTypeRegistry contains the list of the item types supported by the
+// manifest builder. The order of the registration is maintained.
+type ItemTypeRegistry struct {
+	types []*ItemType
+}
+
+func NewItemTypeRegistry() *ItemTypeRegistry {
+	ans := &ItemTypeRegistry{
+		types: []*ItemType{},
+	}
+
+	for _, t := range builtinItemTypes() {
+		// Builtin types are always valid.
+		ans.Register(t)
+	}
+
+	return ans
+}
+
+// NewItemTypeRegistryFromConfig returns a registry with the builtin
+// item types and the custom types defined in the tree configuration.
+func NewItemTypeRegistryFromConfig(c *config.BuilderTreeConfig) (*ItemTypeRegistry, error) {
+	ans := NewItemTypeRegistry()
+
+	for _, t := range c.ItemTypes {
+		err := ans.Register(ItemType{
+			Name:         t.Name,
+			Pattern:      t.Pattern,
+			FileType:     t.FileType,
+			Kind:         t.Kind,
+			CombinedHash: t.CombinedHash,
+			Default:      t.Default,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Every combined hash field of the items is fed by only one
+	// rootfs item type.
+	defaults := []*ItemType{}
+	for _, t := range ans.types {
+		if t.Default {
+			defaults = append(defaults, t)
+		}
+	}
+	if err := checkCombinedHashes(defaults); err != nil {
+		return nil, fmt.Errorf("Default item types: %s", err.Error())
+	}
+
+	for idx := range c.Products {
+		types, err := ans.ProductItemTypes(&c.Products[idx])
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCombinedHashes(types); err != nil {
+			return nil, fmt.Errorf("Item types of product %s: %s",
+				c.Products[idx].Name, err.Error())
+		}
+	}
+
+	return ans, nil
+}
+
+// checkCombinedHashes returns an error if two item types feed the
+// same combined hash field.
+func checkCombinedHashes(types []*ItemType) error {
+	owners := make(map[string]string, 0)
+
+	for _, t := range types {
+		if t.CombinedHash == CombinedHashNone {
+			continue
+		}
+		if owner, ok := owners[t.CombinedHash]; ok {
+			return fmt.Errorf("%s and %s feed the same combined hash %s",
+				owner, t.Name, t.CombinedHash)
+		}
+		owners[t.CombinedHash] = t.Name
+	}
+
+	return nil
+}
+
+func builtinItemTypes() []ItemType {
+	return []ItemType{
+		{
+			Name:     config.ItemTypeLxdTarXz,
+			Pattern:  "lxd.tar.xz",
+			FileType: "lxd.tar.xz",
+			Kind:     ItemKindMetadata,
+			Default:  true,
+		},
+		{
+			Name:     config.ItemTypeIncusTarXz,
+			Pattern:  "incus.tar.xz",
+			FileType: "incus.tar.xz",
+			Kind:     ItemKindMetadata,
+			Default:  true,
+		},
+		{
+			Name:         config.ItemTypeRootSquashFs,
+			Pattern:      "rootfs.squashfs",
+			FileType:     "squashfs",
+			Kind:         ItemKindRootfs,
+			CombinedHash: CombinedHashSquashFs,
+			Default:      true,
+		},
+		{
+			Name:         config.ItemTypeRootTarXz,
+			Pattern:      "rootfs.tar.xz",
+			FileType:     "root.tar.xz",
+			Kind:         ItemKindRootfs,
+			CombinedHash: CombinedHashRootXz,
+			Default:      true,
+		},
+		{
+			Name:     config.ItemTypeRootTarZst,
+			Pattern:  "rootfs.tar.zst",
+			FileType: "root.tar.zst",
+			Kind:     ItemKindRootfs,
+		},
+		{
+			Name:     config.ItemTypeRootTarGz,
+			Pattern:  "rootfs.tar.gz",
+			FileType: "root.tar.gz",
+			Kind:     ItemKindRootfs,
+		},
+		{
+			Name:         config.ItemTypeDiskKvmImg,
+			Pattern:      "disk.qcow2",
+			FileType:     "disk-kvm.img",
+			Kind:         ItemKindRootfs,
+			CombinedHash: CombinedHashDiskKvmImg,
+		},
+	}
+}
+
+// Register adds a new item type or replaces the item type with the same name.
+func (r *ItemTypeRegistry) Register(t ItemType) error {
+	if t.Name == "" {
+		return fmt.Errorf("Invalid item type without name")
+	}
+	if t.Pattern == "" {
+		return fmt.Errorf("Item type %s without pattern", t.Name)
+	}
+	if _, err := path.Match(t.Pattern, ""); err != nil {
+		return fmt.Errorf("Item type %s with invalid pattern %s: %s",
+			t.Name, t.Pattern, err.Error())
+	}
+	if t.FileType == "" {
+		return fmt.Errorf("Item type %s without ftype", t.Name)
+	}
+
+	switch t.Kind {
+	case ItemKindMetadata:
+		if t.CombinedHash != CombinedHashNone {
+			return fmt.Errorf("Metadata item type %s can't feed combined hash %s",
+				t.Name, t.CombinedHash)
+		}
+	case ItemKindRootfs:
+		switch t.CombinedHash {
+		case CombinedHashNone, CombinedHashRootXz, CombinedHashSquashFs,
+			CombinedHashDiskKvmImg, CombinedHashDiskImg, CombinedHashUefiImg:
+		default:
+			return fmt.Errorf("Item type %s with invalid combined hash %s",
+				t.Name, t.CombinedHash)
+		}
+	default:
+		return fmt.Errorf("Item type %s with invalid kind %s", t.Name, t.Kind)
+	}
+
+	for idx, it := range r.types {
+		if it.Name == t.Name {
+			r.types[idx] = &t
+			return nil
+		}
+	}
+
+	r.types = append(r.types, &t)
+	return nil
+}
+
+func (r *ItemTypeRegistry) Get(name string) *ItemType {
+	for _, t := range r.types {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (r *ItemTypeRegistry) Types() []*ItemType {
+	return r.types
+}
+
+// ProductItemTypes returns the default item types and the extra
+// item types enabled by the product.
+func (r *ItemTypeRegistry) ProductItemTypes(product *config.SimpleStreamsProduct) ([]*ItemType, error) {
+	ans := []*ItemType{}
+	enabled := make(map[string]bool, 0)
+
+	for _, name := range product.ItemTypes {
+		if r.Get(name) == nil {
+			return nil, fmt.Errorf("Product %s with unknown item type %s",
+				product.Name, name)
+		}
+		enabled[name] = true
+	}
+
+	for _, t := range r.types {
+		if t.Default || enabled[t.Name] {
+			ans = append(ans, t)
+		}
+	}
+
+	return ans, nil
+}
+
+type versionFile struct {
+	Type *ItemType
+	Name string
+	Path string
+	Size int64
+}
+
+// buildVersionItems elaborates the files of a version directory and returns
+// the items of the version. Every file is read only one time: the combined
+// hashes of every couple metadata/rootfs are fed while the files are hashed.
+func buildVersionItems(types []*ItemType, dir, productBasePath string) (map[string]streams.ProductVersionItem, error) {
+	var metadata, rootfs []versionFile
+	ans := make(map[string]streams.ProductVersionItem, 0)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range types {
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+
+			if match, _ := path.Match(t.Pattern, f.Name()); !match {
+				continue
+			}
+
+			vf := versionFile{
+				Type: t,
+				Name: f.Name(),
+				Path: path.Join(dir, f.Name()),
+				Size: f.Size(),
+			}
+			if t.Kind == ItemKindMetadata {
+				metadata = append(metadata, vf)
+			} else {
+				rootfs = append(rootfs, vf)
+			}
+			break
+		}
+	}
+
+	// combined[metadata item][rootfs item]
+	combined := make(map[string]map[string]hash.Hash, 0)
+	for _, m := range metadata {
+		combined[m.Type.Name] = make(map[string]hash.Hash, 0)
+		for _, r := range rootfs {
+			if r.Type.CombinedHash != CombinedHashNone {
+				combined[m.Type.Name][r.Type.Name] = sha256.New()
+			}
+		}
+	}
+
+	for _, m := range metadata {
+		writers := []io.Writer{}
+		for _, h := range combined[m.Type.Name] {
+			writers = append(writers, h)
+		}
+
+		item, err := hashVersionFile(m, productBasePath, writers)
+		if err != nil {
+			return nil, err
+		}
+		ans[m.Type.Name] = *item
+	}
+
+	for _, r := range rootfs {
+		writers := []io.Writer{}
+		for _, m := range metadata {
+			if h, ok := combined[m.Type.Name][r.Type.Name]; ok {
+				writers = append(writers, h)
+			}
+		}
+
+		item, err := hashVersionFile(r, productBasePath, writers)
+		if err != nil {
+			return nil, err
+		}
+		ans[r.Type.Name] = *item
+	}
+
+	for _, m := range metadata {
+		item := ans[m.Type.Name]
+		for _, r := range rootfs {
+			if h, ok := combined[m.Type.Name][r.Type.Name]; ok {
+				setCombinedHash(&item, r.Type.CombinedHash,
+					hex.EncodeToString(h.Sum(nil)))
+			}
+		}
+		ans[m.Type.Name] = item
+	}
+
+	return ans, nil
+}
+
+func hashVersionFile(vf versionFile, productBasePath string, combined []io.Writer) (*streams.ProductVersionItem, error) {
+	var fmd5 hash.Hash = md5.New()
+	var fsha hash.Hash = sha256.New()
+
+	logger.Debug("Check file " + vf.Name)
+
+	file, err := os.OpenFile(vf.Path, os.O_RDONLY, 0665)
+	if err != nil {
+		logger.Error("Error on read file " + vf.Path)
+		return nil, err
+	}
+	defer file.Close()
+
+	writers := append([]io.Writer{fmd5, fsha}, combined...)
+	buf := make([]byte, BYTE_BUFFER_LEN)
+	_, err = io.CopyBuffer(io.MultiWriter(writers...), file, buf)
+	if err != nil {
+		logger.Error("Error read bytes from file " + vf.Path)
+		return nil, err
+	}
+
+	return &streams.ProductVersionItem{
+		Path:       fmt.Sprintf("%s/%s", productBasePath, vf.Name),
+		FileType:   vf.Type.FileType,
+		Size:       vf.Size,
+		HashMd5:    hex.EncodeToString(fmd5.Sum(nil)),
+		HashSha256: hex.EncodeToString(fsha.Sum(nil)),
+	}, nil
+}
+
+func setCombinedHash(item *streams.ProductVersionItem, field, sha string) {
+	switch field {
+	case CombinedHashRootXz:
+		item.CombinedHashSha256RootXz = sha
+		item.CombinedHashSha256 = sha
+	case CombinedHashSquashFs:
+		item.CombinedHashSha256SquashFs = sha
+	case CombinedHashDiskKvmImg:
+		item.CombinedHashSha256DiskKvmImg = sha
+	case CombinedHashDiskImg:
+		item.CombinedHashSha256DiskImg = sha
+	case CombinedHashUefiImg:
+		item.CombinedHashSha256DiskUefiImg = sha
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"testing"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+func TestItemTypeRegistryCombinedHashConflicts(t *testing.T) {
+	c := config.NewBuilderTreeConfig(nil)
+	c.ItemTypes = []config.SimpleStreamsItemType{
+		{
+			Name:         "disk.img",
+			Pattern:      "disk.img",
+			FileType:     "disk-kvm.img",
+			Kind:         ItemKindRootfs,
+			CombinedHash: CombinedHashDiskKvmImg,
+		},
+	}
+	c.Products = []config.SimpleStreamsProduct{
+		{Name: "p1", ItemTypes: []string{"disk.img"}},
+	}
+
+	if _, err := NewItemTypeRegistryFromConfig(c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// disk-kvm.img feeds the same combined hash of disk.img.
+	c.Products[0].ItemTypes = append(c.Products[0].ItemTypes, config.ItemTypeDiskKvmImg)
+	if _, err := NewItemTypeRegistryFromConfig(c); err == nil {
+		t.Error("Expected an error for two item types with the same combined hash")
+	}
+
+	// A default item type conflicts with root.squashfs.
+	c.Products[0].ItemTypes = nil
+	c.ItemTypes[0].CombinedHash = CombinedHashSquashFs
+	c.ItemTypes[0].Default = true
+	if _, err := NewItemTypeRegistryFromConfig(c); err == nil {
+		t.Error("Expected an error for a default item type with the combined hash of root.squashfs")
+	}
+}
@@ -0,0 +1,319 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+)
+
+const (
+	SkipReasonNotFound    = "not-found"
+	SkipReasonFetchError  = "fetch-error"
+	SkipReasonParseError  = "parse-error"
+	SkipReasonInvalidName = "invalid-name"
+)
+
+// ProductManifest contains the result of the load of the ssb.json
+// file of a product.
+type ProductManifest struct {
+	Product  *config.SimpleStreamsProduct `json:"-"`
+	Name     string                       `json:"name"`
+	Source   string                       `json:"source"`
+	Manifest *VersionsSSBuilderManifest   `json:"-"`
+	// SkipReason is empty if the manifest is valid.
+	SkipReason string `json:"skip_reason,omitempty"`
+	Error      error  `json:"-"`
+}
+
+// ManifestsSnapshot contains the manifests of the visible products of
+// the tree loaded in a single pass.
+type ManifestsSnapshot struct {
+	Products []*ProductManifest
+}
+
+// ManifestLoader retrieves the manifests of the products from the
+// prefix_path or from the source directory. The manifests loaded are
+// cached, so the same loader returns always the same snapshot until
+// Reset is called.
+type ManifestLoader struct {
+	Config    *config.BuilderTreeConfig
+	SourceDir string
+
+	mutex sync.Mutex
+	cache map[string]*ProductManifest
+}
+
+func (p *ProductManifest) Skipped() bool {
+	return p.SkipReason != ""
+}
+
+// Message returns a description of the skip reason.
+func (p *ProductManifest) Message() string {
+	switch p.SkipReason {
+	case "":
+		return ""
+	case SkipReasonNotFound:
+		return "ssb.json file not found."
+	case SkipReasonInvalidName:
+		return "It contains invalid ssb.json file."
+	}
+
+	if p.Error != nil {
+		return "Error on parse ssb.json: " + p.Error.Error()
+	}
+	return p.SkipReason
+}
+
+func (s *ManifestsSnapshot) Available() []*ProductManifest {
+	ans := []*ProductManifest{}
+	for _, p := range s.Products {
+		if !p.Skipped() {
+			ans = append(ans, p)
+		}
+	}
+	return ans
+}
+
+func (s *ManifestsSnapshot) Skipped() []*ProductManifest {
+	ans := []*ProductManifest{}
+	for _, p := range s.Products {
+		if p.Skipped() {
+			ans = append(ans, p)
+		}
+	}
+	return ans
+}
+
+func NewManifestLoader(c *config.BuilderTreeConfig, sourceDir string) *ManifestLoader {
+	return &ManifestLoader{
+		Config:    c,
+		SourceDir: sourceDir,
+		cache:     make(map[string]*ProductManifest, 0),
+	}
+}
+
+// Reset cleans the cache of the loader.
+func (l *ManifestLoader) Reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.cache = make(map[string]*ProductManifest, 0)
+}
+
+// Load returns the manifests of all visible products. The remote
+// manifests are retrieved concurrently.
+func (l *ManifestLoader) Load(ctx context.Context) (*ManifestsSnapshot, error) {
+	var requests []FetchRequest
+	ans := &ManifestsSnapshot{
+		Products: []*ProductManifest{},
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for idx := range l.Config.Products {
+		p := &l.Config.Products[idx]
+		if p.Hidden {
+			continue
+		}
+
+		if p.PrefixPath == "" && l.SourceDir == "" {
+			return nil, fmt.Errorf(
+				"Product %s without prefix_path but source-dir is empty.",
+				p.Name)
+		}
+
+		if _, ok := l.cache[p.Name]; ok || p.PrefixPath == "" {
+			continue
+		}
+
+		requests = append(requests, FetchRequest{
+			Url:  ProductManifestUrl(p),
+			Auth: ResolveProductAuth(l.Config, p),
+		})
+	}
+
+	remotes := make(map[string]*FetchResult, 0)
+	if len(requests) > 0 {
+		fetcher, err := NewManifestFetcher(l.Config.Http)
+		if err != nil {
+			return nil, err
+		}
+		remotes = fetcher.FetchAll(ctx, requests)
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	for idx := range l.Config.Products {
+		p := &l.Config.Products[idx]
+		if p.Hidden {
+			continue
+		}
+
+		pm, ok := l.cache[p.Name]
+		if !ok {
+			if p.PrefixPath != "" {
+				r := FetchRequest{
+					Url:  ProductManifestUrl(p),
+					Auth: ResolveProductAuth(l.Config, p),
+				}
+				pm = newRemoteProductManifest(p, remotes[r.Key()])
+			} else {
+				pm = l.loadLocal(p)
+			}
+			l.cache[p.Name] = pm
+
+			if pm.Skipped() {
+				logger.WithFields(logger.Fields{
+					"product": p.Name,
+					"reason":  pm.SkipReason,
+				}).Warningf("Product %s is skipped. %s", p.Name, pm.Message())
+			}
+		}
+
+		ans.Products = append(ans.Products, pm)
+	}
+
+	return ans, nil
+}
+
+func (l *ManifestLoader) loadLocal(p *config.SimpleStreamsProduct) *ProductManifest {
+	ans := &ProductManifest{
+		Product: p,
+		Name:    p.Name,
+		Source:  path.Join(l.SourceDir, p.Directory, "/ssb.json"),
+	}
+
+	logger.Debug("Check ssb file", ans.Source)
+
+	if _, err := os.Stat(ans.Source); os.IsNotExist(err) {
+		ans.SkipReason = SkipReasonNotFound
+		ans.Error = err
+		return ans
+	}
+
+	ans.Manifest, ans.Error = ReadVersionsManifestJson(ans.Source)
+	ans.validate()
+
+	return ans
+}
+
+func newRemoteProductManifest(p *config.SimpleStreamsProduct, r *FetchResult) *ProductManifest {
+	ans := &ProductManifest{
+		Product: p,
+		Name:    p.Name,
+		Source:  ProductManifestUrl(p),
+	}
+
+	if r == nil {
+		ans.Error = fmt.Errorf("No fetch result for url %s", ans.Source)
+	} else {
+		ans.Manifest, ans.Error = r.Manifest, r.Error
+	}
+
+	if ans.Error != nil {
+		switch ans.Error.(type) {
+		case *json.SyntaxError, *json.UnmarshalTypeError:
+			ans.SkipReason = SkipReasonParseError
+		default:
+			ans.SkipReason = SkipReasonFetchError
+		}
+		return ans
+	}
+
+	ans.validate()
+
+	return ans
+}
+
+func (p *ProductManifest) validate() {
+	if p.Error != nil {
+		p.SkipReason = SkipReasonParseError
+	} else if p.Manifest.Name != p.Product.Name {
+		p.SkipReason = SkipReasonInvalidName
+		p.Error = fmt.Errorf("Manifest name %s doesn't match with product %s",
+			p.Manifest.Name, p.Product.Name)
+	}
+}
+
+// SkippedProduct describes a product skipped by the loader.
+type SkippedProduct struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SkipReport is the machine-readable report of the products skipped.
+type SkipReport struct {
+	Products  int              `json:"products"`
+	Available int              `json:"available"`
+	Skipped   []SkippedProduct `json:"skipped"`
+}
+
+func (s *ManifestsSnapshot) SkipReport() *SkipReport {
+	ans := &SkipReport{
+		Products: len(s.Products),
+		Skipped:  []SkippedProduct{},
+	}
+
+	for _, p := range s.Products {
+		if !p.Skipped() {
+			ans.Available++
+			continue
+		}
+
+		sp := SkippedProduct{
+			Name:   p.Name,
+			Source: p.Source,
+			Reason: p.SkipReason,
+		}
+		if p.Error != nil {
+			sp.Error = p.Error.Error()
+		}
+		ans.Skipped = append(ans.Skipped, sp)
+	}
+
+	return ans
+}
+
+// CheckSkipped returns an error if strict is true and there are
+// skipped products or if the skipped products are more than maxSkipped.
+// A negative maxSkipped disables the threshold.
+func (s *ManifestsSnapshot) CheckSkipped(strict bool, maxSkipped int) error {
+	skipped := s.Skipped()
+
+	if strict && len(skipped) > 0 {
+		names := []string{}
+		for _, p := range skipped {
+			names = append(names, fmt.Sprintf("%s (%s)", p.Name, p.SkipReason))
+		}
+		return fmt.Errorf("Strict mode: %d products skipped: %s",
+			len(skipped), strings.Join(names, ", "))
+	}
+
+	if maxSkipped >= 0 && len(skipped) > maxSkipped {
+		return fmt.Errorf("Skipped %d products on %d. Threshold is %d.",
+			len(skipped), len(s.Products), maxSkipped)
+	}
+
+	return nil
+}
+
+func WriteSkipReportJson(report *SkipReport, out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
@@ -0,0 +1,210 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+	tools "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
+)
+
+// ImageMetadataFilename is the file with the metadata of the image
+// inside the metadata tarball.
+const ImageMetadataFilename = "metadata.yaml"
+
+var (
+	xzMagic   = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+	gzipMagic = []byte{0x1F, 0x8B}
+	zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+)
+
+// ImageMetadata contains the metadata.yaml of a LXD/Incus image.
+type ImageMetadata struct {
+	Architecture string            `yaml:"architecture"`
+	CreationDate int64             `yaml:"creation_date"`
+	ExpiryDate   int64             `yaml:"expiry_date"`
+	Properties   map[string]string `yaml:"properties"`
+}
+
+func (m *ImageMetadata) Created() time.Time {
+	if m.CreationDate <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(m.CreationDate, 0)
+}
+
+func (m *ImageMetadata) Expiry() time.Time {
+	if m.ExpiryDate <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(m.ExpiryDate, 0)
+}
+
+// Property returns the value of a property or an empty string.
+func (m *ImageMetadata) Property(name string) string {
+	if m.Properties == nil {
+		return ""
+	}
+	return m.Properties[name]
+}
+
+// Check returns the differences between the metadata and the product.
+// The architectures are compared with the LXD names.
+func (m *ImageMetadata) Check(product *config.SimpleStreamsProduct) []string {
+	ans := []string{}
+
+	if m.Architecture != "" && product.Architecture != "" &&
+		LxdArchitecture(m.Architecture) != LxdArchitecture(product.Architecture) {
+		ans = append(ans, fmt.Sprintf("architecture %s is different from arch %s of product",
+			m.Architecture, product.Architecture))
+	}
+
+	release := m.Property("release")
+	if release != "" && product.Release != "" && release != product.Release {
+		ans = append(ans, fmt.Sprintf("release %s is different from release %s of product",
+			release, product.Release))
+	}
+
+	return ans
+}
+
+// ReadImageMetadata reads the metadata.yaml file from a metadata
+// tarball. The tarball could be compressed with xz, gzip or zstd.
+// The xz and zstd formats require the xz and zstd commands.
+func ReadImageMetadata(file string) (*ImageMetadata, error) {
+	var reader io.Reader
+	var cmd *exec.Cmd
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buffered := bufio.NewReader(f)
+	magic, _ := buffered.Peek(6)
+
+	switch {
+	case bytes.HasPrefix(magic, xzMagic):
+		cmd = exec.Command("xz", "-dc")
+	case bytes.HasPrefix(magic, zstdMagic):
+		cmd = exec.Command("zstd", "-dc")
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("Error on read %s: %s", file, err.Error())
+		}
+		defer gz.Close()
+		reader = gz
+	default:
+		reader = buffered
+	}
+
+	if cmd != nil {
+		cmd.Stdin = buffered
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		err = cmd.Start()
+		if err != nil {
+			return nil, fmt.Errorf("Error on decompress %s: %s", file, err.Error())
+		}
+		defer func() {
+			// The rest of the tarball is not needed.
+			stdout.Close()
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+		reader = stdout
+	}
+
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error on read tarball %s: %s", file, err.Error())
+		}
+
+		if path.Clean(strings.TrimPrefix(header.Name, "/")) != ImageMetadataFilename {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("Error on read %s from %s: %s",
+				ImageMetadataFilename, file, err.Error())
+		}
+
+		ans := &ImageMetadata{}
+		err = yaml.Unmarshal(data, ans)
+		if err != nil {
+			return nil, fmt.Errorf("Error on parse %s from %s: %s",
+				ImageMetadataFilename, file, err.Error())
+		}
+
+		return ans, nil
+	}
+
+	return nil, fmt.Errorf("No %s found on %s", ImageMetadataFilename, file)
+}
+
+// versionBuildDate returns the creation_date of the metadata of the
+// version or, if not available, the date of the version name.
+func versionBuildDate(types []*ItemType, dir, version string) (time.Time, error) {
+	m, _, err := readVersionMetadata(types, dir)
+	if err == nil && m != nil && !m.Created().IsZero() {
+		return m.Created(), nil
+	}
+
+	return tools.ParseVersionDate(version)
+}
+
+// readVersionMetadata reads the metadata of the first metadata item
+// available on the version directory.
+func readVersionMetadata(types []*ItemType, dir string) (*ImageMetadata, string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, t := range types {
+		if t.Kind != ItemKindMetadata {
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			if match, _ := path.Match(t.Pattern, f.Name()); !match {
+				continue
+			}
+
+			file := path.Join(dir, f.Name())
+			m, err := ReadImageMetadata(file)
+			return m, file, err
+		}
+	}
+
+	logger.Debugf("No metadata tarball found on %s.", dir)
+	return nil, "", nil
+}
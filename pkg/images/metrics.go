@@ -0,0 +1,230 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tools "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
+)
+
+// ProductMetrics contains the metrics of a published product.
+type ProductMetrics struct {
+	Name            string
+	OperatingSystem string
+	Release         string
+	Architecture    string
+	Versions        int
+	// Timestamp of the newest version. Zero if there are no versions.
+	NewestVersion time.Time
+	TotalBytes    int64
+	// Size of the items of the newest version.
+	NewestBytes int64
+	// Support EOL of the product. Zero if not defined.
+	SupportEOL time.Time
+}
+
+// TreeMetrics contains the metrics of the tree.
+type TreeMetrics struct {
+	Products  []ProductMetrics
+	Total     int
+	Available int
+	// Number of the skipped products for skip reason.
+	Skipped   map[string]int
+	Generated time.Time
+}
+
+// BuildTreeMetrics elaborates the metrics from the manifests loaded.
+func BuildTreeMetrics(snapshot *ManifestsSnapshot) *TreeMetrics {
+	ans := &TreeMetrics{
+		Products:  []ProductMetrics{},
+		Total:     len(snapshot.Products),
+		Skipped:   make(map[string]int, 0),
+		Generated: time.Now(),
+	}
+
+	for _, p := range snapshot.Products {
+		if p.Skipped() {
+			ans.Skipped[p.SkipReason]++
+			continue
+		}
+		ans.Available++
+
+		pm := ProductMetrics{
+			Name:            p.Name,
+			OperatingSystem: p.Product.OperatingSystem,
+			Release:         p.Product.Release,
+			Architecture:    p.Product.Architecture,
+			Versions:        len(p.Manifest.Versions),
+		}
+
+		newest := ""
+		for v, version := range p.Manifest.Versions {
+			size := int64(0)
+			for _, item := range version.Items {
+				size += item.Size
+			}
+			pm.TotalBytes += size
+
+			if v > newest {
+				newest = v
+				pm.NewestBytes = size
+			}
+		}
+
+		if newest != "" {
+			if t, err := tools.ParseVersionDate(newest); err == nil {
+				pm.NewestVersion = t
+			}
+		}
+
+		if p.Manifest.SupportEOL != "" {
+			if eol, err := strconv.ParseInt(p.Manifest.SupportEOL, 10, 64); err == nil {
+				pm.SupportEOL = time.Unix(eol, 0)
+			}
+		}
+
+		ans.Products = append(ans.Products, pm)
+	}
+
+	sort.Slice(ans.Products, func(i, j int) bool {
+		return ans.Products[i].Name < ans.Products[j].Name
+	})
+
+	return ans
+}
+
+// WriteMetricsText writes the metrics in the Prometheus text format.
+func WriteMetricsText(m *TreeMetrics, out io.Writer) error {
+	var b strings.Builder
+
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	labels := func(p *ProductMetrics) string {
+		return fmt.Sprintf(`product="%s",os="%s",release="%s",arch="%s"`,
+			escapeLabel(p.Name), escapeLabel(p.OperatingSystem),
+			escapeLabel(p.Release), escapeLabel(p.Architecture))
+	}
+
+	gauge("ssb_product_versions", "Number of versions of the product.")
+	for i := range m.Products {
+		fmt.Fprintf(&b, "ssb_product_versions{%s} %d\n",
+			labels(&m.Products[i]), m.Products[i].Versions)
+	}
+
+	gauge("ssb_product_newest_version_timestamp_seconds",
+		"Build time of the newest version of the product.")
+	for i := range m.Products {
+		if m.Products[i].NewestVersion.IsZero() {
+			continue
+		}
+		fmt.Fprintf(&b, "ssb_product_newest_version_timestamp_seconds{%s} %d\n",
+			labels(&m.Products[i]), m.Products[i].NewestVersion.Unix())
+	}
+
+	gauge("ssb_product_bytes", "Total size of the items of all versions of the product.")
+	for i := range m.Products {
+		fmt.Fprintf(&b, "ssb_product_bytes{%s} %d\n",
+			labels(&m.Products[i]), m.Products[i].TotalBytes)
+	}
+
+	gauge("ssb_product_newest_version_bytes",
+		"Size of the items of the newest version of the product.")
+	for i := range m.Products {
+		fmt.Fprintf(&b, "ssb_product_newest_version_bytes{%s} %d\n",
+			labels(&m.Products[i]), m.Products[i].NewestBytes)
+	}
+
+	gauge("ssb_product_support_eol_timestamp_seconds",
+		"Support EOL of the product.")
+	for i := range m.Products {
+		if m.Products[i].SupportEOL.IsZero() {
+			continue
+		}
+		fmt.Fprintf(&b, "ssb_product_support_eol_timestamp_seconds{%s} %d\n",
+			labels(&m.Products[i]), m.Products[i].SupportEOL.Unix())
+	}
+
+	gauge("ssb_products", "Number of visible products of the tree.")
+	fmt.Fprintf(&b, "ssb_products %d\n", m.Total)
+
+	gauge("ssb_products_available", "Number of products with a valid manifest.")
+	fmt.Fprintf(&b, "ssb_products_available %d\n", m.Available)
+
+	reasons := []string{
+		SkipReasonNotFound, SkipReasonFetchError,
+		SkipReasonParseError, SkipReasonInvalidName,
+	}
+	for r := range m.Skipped {
+		found := false
+		for _, k := range reasons {
+			if k == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			reasons = append(reasons, r)
+		}
+	}
+
+	gauge("ssb_products_skipped", "Number of products skipped for reason.")
+	for _, r := range reasons {
+		fmt.Fprintf(&b, "ssb_products_skipped{reason=\"%s\"} %d\n",
+			escapeLabel(r), m.Skipped[r])
+	}
+
+	gauge("ssb_metrics_generated_timestamp_seconds",
+		"Time of the generation of the metrics.")
+	fmt.Fprintf(&b, "ssb_metrics_generated_timestamp_seconds %d\n", m.Generated.Unix())
+
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+// WriteMetricsFile writes the metrics to the file atomically, so the
+// textfile collector never reads a partial file.
+func WriteMetricsFile(m *TreeMetrics, file string) error {
+	dir := filepath.Dir(file)
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = WriteMetricsText(m, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), file)
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
@@ -0,0 +1,59 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+// DefinitionOverrides returns the definition fields of the product
+// that override the image file. If enabled or if the product
+// enables them, the arch, the release and the os of the product
+// are used. The options of the product are always used and they
+// have the precedence.
+func DefinitionOverrides(product *config.SimpleStreamsProduct, enabled bool) map[string]string {
+	ans := make(map[string]string)
+
+	if enabled || product.DefinitionOverrides {
+		if product.Architecture != "" {
+			ans["image.architecture"] = product.Architecture
+		}
+		if product.Release != "" {
+			ans["image.release"] = product.Release
+		}
+		if product.OperatingSystem != "" {
+			// distrobuilder uses the lowercase name (Alpine -> alpine).
+			ans["image.distribution"] = strings.ToLower(product.OperatingSystem)
+		}
+	}
+
+	for k, v := range product.Options {
+		ans[k] = v
+	}
+
+	return ans
+}
+
+// DefinitionOverrideArgs returns the -o arguments of distrobuilder
+// sorted by key.
+func DefinitionOverrideArgs(product *config.SimpleStreamsProduct, enabled bool) []string {
+	var ans []string
+
+	overrides := DefinitionOverrides(product, enabled)
+	keys := make([]string, 0, len(overrides))
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ans = append(ans, "-o", fmt.Sprintf("%s=%s", k, overrides[k]))
+	}
+
+	return ans
+}
@@ -22,15 +22,19 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package images
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	exec "os/exec"
 	"path"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
 	tools "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
 )
 
@@ -39,6 +43,16 @@ type BuildProductOpts struct {
 	BuildLxd        bool
 	PurgeOldImages  bool
 	BuildScriptHook string
+	// Time to wait after the forward of the interrupt signal to the
+	// distrobuilder and hook processes before kill them.
+	GracePeriod time.Duration
+	// Report collects phases, artifacts and purged directories. Could be nil.
+	Report *BuildReport
+	// Pass the product fields to distrobuilder as definition overrides
+	// also if the product doesn't enable them.
+	DefinitionOverrides bool
+	// Values of the tree used to render the image file if it's a template.
+	Values map[string]interface{}
 }
 
 func NewBuildProductOpts() *BuildProductOpts {
@@ -47,10 +61,35 @@ func NewBuildProductOpts() *BuildProductOpts {
 		BuildLxd:        true,
 		PurgeOldImages:  true,
 		BuildScriptHook: "",
+		GracePeriod:     10 * time.Second,
 	}
 }
 
-func BuildProduct(product *config.SimpleStreamsProduct, targetDir, imageFile string, opts *BuildProductOpts) error {
+func BuildProduct(ctx context.Context, product *config.SimpleStreamsProduct, targetDir, imageFile string, opts *BuildProductOpts) error {
+	if opts.Report != nil {
+		opts.Report.Product = product.Name
+		version, err := DistrobuilderVersion()
+		if err != nil {
+			logger.Warningf("Error on retrieve distrobuilder version: %s", err.Error())
+		}
+		opts.Report.DistrobuilderVersion = version
+	}
+
+	err := buildProduct(ctx, product, targetDir, imageFile, opts)
+	if err == nil && opts.Report != nil {
+		// The images are available, the build is successful also if
+		// the artifacts are not all reported.
+		if aerr := opts.Report.AddArtifacts(opts.Report.VersionDir); aerr != nil {
+			logger.Warningf("Error on add the artifacts of %s to the build report: %s",
+				opts.Report.VersionDir, aerr.Error())
+		}
+	}
+	opts.Report.Done(err, ctx.Err() != nil)
+
+	return err
+}
+
+func buildProduct(ctx context.Context, product *config.SimpleStreamsProduct, targetDir, imageFile string, opts *BuildProductOpts) error {
 	var fileInfo *os.FileInfo = nil
 	var err error
 	var productDir, dateDir, tmpDir, cacheDir string
@@ -58,13 +97,18 @@ func BuildProduct(product *config.SimpleStreamsProduct, targetDir, imageFile str
 	// Hereinafter, a summary of all operations to do:
 	// 1. Create target directory if doesn't exist (with date)
 	// 2. Check if exists TMPDIR else create it.
-	// 3. Create cachedir (CACHEDIR) if doesn't exist.
+	// 3. Create the cachedir of the build under CACHEDIR.
 	// 4. Run distrobuilder build-lxc if option BuildLxc is true
 	// 5. Run distrobuilder build-lxd if option BuildLxd is true
 	// 6. Purge old images if option PurgeOldImages is true
 	// 7. Create images manifest if option CreateImagesManifest is true
 
 	productDir = path.Join(targetDir, product.Directory)
+	overrides := DefinitionOverrideArgs(product, opts.DefinitionOverrides)
+	if len(overrides) > 0 {
+		logger.Infof("Using definition overrides for product %s: %v",
+			product.Name, overrides)
+	}
 	tmpDir = os.Getenv("TMPDIR")
 	cacheDir = os.Getenv("CACHEDIR")
 
@@ -75,6 +119,33 @@ func BuildProduct(product *config.SimpleStreamsProduct, targetDir, imageFile str
 		cacheDir = "/tmp/cachedir"
 	}
 
+	hookScript := product.BuildScriptHook
+	if opts.BuildScriptHook != "" {
+		// Override hookScript
+		hookScript = opts.BuildScriptHook
+	}
+
+	buildLxd, buildIncus := MetadataTargets(product.MetadataMode)
+	if !opts.BuildLxd {
+		buildLxd, buildIncus = false, false
+	}
+
+	// With both the metadata tarballs the rootfs is built only one
+	// time and packed for LXD and for Incus.
+	splitBuild := hookScript != "" ||
+		(buildLxd && buildIncus && DistrobuilderSupports(BuildPhasePackIncus))
+
+	if buildIncus {
+		incusCommand := BuildPhaseBuildIncus
+		if splitBuild {
+			incusCommand = BuildPhasePackIncus
+		}
+		if !DistrobuilderSupports(incusCommand) {
+			return fmt.Errorf("distrobuilder doesn't support %s required by metadata mode %s of product %s. Use metadata_mode bridged or lxd-only.",
+				incusCommand, product.MetadataMode, product.Name)
+		}
+	}
+
 	// Make target directory
 	fileInfo, err = tools.MkdirIfNotExist(productDir, 0760)
 	if err != nil {
@@ -86,15 +157,24 @@ func BuildProduct(product *config.SimpleStreamsProduct, targetDir, imageFile str
 	// Create temporary directory used by distrobuilder if doesn't exist
 	_, err = tools.MkdirIfNotExist(tmpDir, 0760)
 	if err != nil {
-		fmt.Println("Error on create tmp directory: " + err.Error())
+		logger.Error("Error on create tmp directory: " + err.Error())
 		return err
 	}
 	// Create cachedir directory
 	_, err = tools.MkdirIfNotExist(cacheDir, 0760)
 	if err != nil {
-		fmt.Println("Error on create cachedir directory: " + err.Error())
+		logger.Error("Error on create cachedir directory: " + err.Error())
 		return err
 	}
+	// Every build uses its cache directory because distrobuilder
+	// cleans it up and the builds could run in parallel.
+	cacheDir, err = ioutil.TempDir(cacheDir,
+		strings.ReplaceAll(product.Name, "/", "_")+"-")
+	if err != nil {
+		logger.Error("Error on create cachedir directory: " + err.Error())
+		return err
+	}
+	defer os.RemoveAll(cacheDir)
 
 	if opts.BuildLxc || opts.BuildLxd {
 		// Directory must be in the format: "20190407_13:00"
@@ -103,70 +183,116 @@ func BuildProduct(product *config.SimpleStreamsProduct, targetDir, imageFile str
 			fmt.Sprintf("%4d%02d%02d_%02d:%02d",
 				now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute()),
 		)
-		_, err = tools.MkdirIfNotExist(dateDir, 0760)
+		fileInfo, err = tools.MkdirIfNotExist(dateDir, 0760)
 		if err != nil {
 			return err
 		}
 
-		fmt.Println(fmt.Sprintf("Created directory %s for image of the product %s.",
-			dateDir, product.Name))
+		if fileInfo == nil {
+			// POST: the directory is new. On interruption the partial
+			// version is removed.
+			partialDir := dateDir
+			defer func() {
+				if ctx.Err() != nil {
+					logger.Warningf("Build interrupted. Removing partial directory %s.",
+						partialDir)
+					tools.RemoveDirIfNotExist(partialDir)
+				}
+			}()
+		}
+
+		logger.Infof("Created directory %s for image of the product %s.",
+			dateDir, product.Name)
+
+		if opts.Report != nil {
+			opts.Report.VersionDir = dateDir
+		}
 	}
 
-	if product.BuildScriptHook != "" || opts.BuildScriptHook != "" {
+	if IsDefinitionTemplate(imageFile) {
+		// The rendered file is kept with the artifacts of the version.
+		renderDir := dateDir
+		if renderDir == "" {
+			renderDir, err = ioutil.TempDir(tmpDir, "ssb-definition")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(renderDir)
+		}
+
+		imageFile, err = RenderDefinitionFile(product, opts.Values, imageFile, renderDir)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Rendered image file %s for product %s.", imageFile, product.Name)
 
-		hookScript := product.BuildScriptHook
-		if opts.BuildScriptHook != "" {
-			// Override hookScript
-			hookScript = opts.BuildScriptHook
+		if opts.Report != nil {
+			opts.Report.Definition = imageFile
 		}
+	}
 
-		fmt.Println(fmt.Sprintf(
-			"Found hook %s. I will prepare the chroot for packaging.",
-			hookScript,
-		))
+	if splitBuild {
+
+		if hookScript != "" {
+			logger.Infof(
+				"Found hook %s. I will prepare the chroot for packaging.",
+				hookScript,
+			)
+		}
 
 		// Create rootfs directory
 		rootfsDir := path.Join(dateDir, "staging")
 		buildDirCommand := exec.Command("distrobuilder",
-			"build-dir", imageFile, rootfsDir,
-			"--cache-dir", cacheDir)
+			append([]string{"build-dir", imageFile, rootfsDir,
+				"--cache-dir", cacheDir}, overrides...)...)
 		defer tools.RemoveDirIfNotExist(rootfsDir)
 
 		buildDirCommand.Stdout = os.Stdout
 		buildDirCommand.Stderr = os.Stderr
 
-		err = buildDirCommand.Run()
+		err = opts.Report.Phase(BuildPhaseBuildDir, func() error {
+			return tools.RunCommand(ctx, buildDirCommand, opts.GracePeriod)
+		})
 		if err != nil {
 			return err
 		}
 
-		runHookCommand := exec.Command(hookScript)
-		// Prepare env for hook
-		runHookCommand.Env = append(os.Environ(),
-			fmt.Sprintf("%s_STAGING_DIR=%s", config.SSB_ENV_PREFIX, rootfsDir),
-			fmt.Sprintf("%s_BUILD_PRODUCT=%s", config.SSB_ENV_PREFIX, product.Name))
+		if hookScript != "" {
+			runHookCommand := exec.Command(hookScript)
+			// Prepare env for hook
+			runHookCommand.Env = append(os.Environ(),
+				fmt.Sprintf("%s_STAGING_DIR=%s", config.SSB_ENV_PREFIX, rootfsDir),
+				fmt.Sprintf("%s_BUILD_PRODUCT=%s", config.SSB_ENV_PREFIX, product.Name))
 
-		runHookCommand.Stdout = os.Stdout
-		runHookCommand.Stderr = os.Stderr
+			runHookCommand.Stdout = os.Stdout
+			runHookCommand.Stderr = os.Stderr
 
-		err = runHookCommand.Run()
-		if err != nil {
-			fmt.Println(fmt.Sprintf("Error on execute hook %s: %s",
-				hookScript, err.Error()))
-			return err
+			err = opts.Report.Phase(BuildPhaseHook, func() error {
+				return tools.RunCommand(ctx, runHookCommand, opts.GracePeriod)
+			})
+			if err != nil {
+				logger.Errorf("Error on execute hook %s: %s",
+					hookScript, err.Error())
+				return err
+			}
 		}
 
 		// Create LXC package
 		if opts.BuildLxc {
-			err = packImage(imageFile, rootfsDir, dateDir, cacheDir, "pack-lxc")
+			err = opts.Report.Phase(BuildPhasePackLxc, func() error {
+				return packImage(ctx, imageFile, rootfsDir, dateDir, cacheDir, BuildPhasePackLxc, overrides, opts.GracePeriod)
+			})
 			if err != nil {
 				return err
 			}
 		}
 
-		// Create LXD package
-		if opts.BuildLxd {
-			err = packImage(imageFile, rootfsDir, dateDir, cacheDir, "pack-lxd")
+		// Create LXD/Incus packages
+		for _, phase := range metadataPhases(buildLxd, buildIncus, BuildPhasePackLxd, BuildPhasePackIncus) {
+			subCommand := phase
+			err = opts.Report.Phase(phase, func() error {
+				return packImage(ctx, imageFile, rootfsDir, dateDir, cacheDir, subCommand, overrides, opts.GracePeriod)
+			})
 			if err != nil {
 				return err
 			}
@@ -176,14 +302,16 @@ func BuildProduct(product *config.SimpleStreamsProduct, targetDir, imageFile str
 
 		if opts.BuildLxc {
 			buildLxcCommand := exec.Command("distrobuilder",
-				"build-lxc", imageFile, dateDir,
-				"--cache-dir", cacheDir)
+				append([]string{"build-lxc", imageFile, dateDir,
+					"--cache-dir", cacheDir}, overrides...)...)
 
 			// https://blog.kowalczyk.info/article/wOYk/advanced-command-execution-in-go-with-osexec.html
 			buildLxcCommand.Stdout = os.Stdout
 			buildLxcCommand.Stderr = os.Stderr
 
-			err = buildLxcCommand.Run()
+			err = opts.Report.Phase(BuildPhaseBuildLxc, func() error {
+				return tools.RunCommand(ctx, buildLxcCommand, opts.GracePeriod)
+			})
 			if err != nil {
 				return err
 			}
@@ -195,15 +323,25 @@ func BuildProduct(product *config.SimpleStreamsProduct, targetDir, imageFile str
 			}
 		}
 
-		if opts.BuildLxd {
-			buildLxdCommand := exec.Command("distrobuilder",
-				"build-lxd", imageFile, dateDir,
-				"--cache-dir", cacheDir)
+		// POST: with both the targets pack-incus is not supported and
+		// the rootfs is built for LXD and for Incus.
+		for _, phase := range metadataPhases(buildLxd, buildIncus, BuildPhaseBuildLxd, BuildPhaseBuildIncus) {
+			buildCommand := exec.Command("distrobuilder",
+				append([]string{phase, imageFile, dateDir,
+					"--cache-dir", cacheDir}, overrides...)...)
 
-			buildLxdCommand.Stdout = os.Stdout
-			buildLxdCommand.Stderr = os.Stderr
+			buildCommand.Stdout = os.Stdout
+			buildCommand.Stderr = os.Stderr
 
-			err = buildLxdCommand.Run()
+			err = opts.Report.Phase(phase, func() error {
+				return tools.RunCommand(ctx, buildCommand, opts.GracePeriod)
+			})
+			if err != nil {
+				return err
+			}
+
+			// Create cache dir cleanup by distrobuilder
+			_, err = tools.MkdirIfNotExist(cacheDir, 0760)
 			if err != nil {
 				return err
 			}
@@ -212,13 +350,49 @@ func BuildProduct(product *config.SimpleStreamsProduct, targetDir, imageFile str
 	}
 
 	if opts.PurgeOldImages {
-		err = purgeOldImages(productDir, product)
+		err = opts.Report.Phase(BuildPhasePurge, func() error {
+			purged, err := purgeOldImages(productDir, product)
+			if opts.Report != nil {
+				opts.Report.Purged = append(opts.Report.Purged, purged...)
+			}
+			return err
+		})
 	}
 
-	return nil
+	return err
+}
+
+// metadataPhases returns the phases, named as the distrobuilder
+// sub-commands, that create the metadata tarballs.
+func metadataPhases(lxd, incus bool, lxdPhase, incusPhase string) []string {
+	ans := []string{}
+	if lxd {
+		ans = append(ans, lxdPhase)
+	}
+	if incus {
+		ans = append(ans, incusPhase)
+	}
+	return ans
+}
+
+// distrobuilderCommands caches the sub-commands supported by distrobuilder.
+var distrobuilderCommands sync.Map
+
+// DistrobuilderSupports returns true if distrobuilder supports the
+// sub-command.
+func DistrobuilderSupports(subCommand string) bool {
+	if ans, ok := distrobuilderCommands.Load(subCommand); ok {
+		return ans.(bool)
+	}
+
+	ans := exec.Command("distrobuilder", subCommand, "--help").Run() == nil
+	distrobuilderCommands.Store(subCommand, ans)
+
+	return ans
 }
 
-func packImage(imageFile, rootfsDir, dateDir, cacheDir, subCommand string) error {
+func packImage(ctx context.Context, imageFile, rootfsDir, dateDir, cacheDir, subCommand string,
+	overrides []string, grace time.Duration) error {
 	var err error
 
 	// Create cache dir cleanup by distrobuilder
@@ -227,16 +401,16 @@ func packImage(imageFile, rootfsDir, dateDir, cacheDir, subCommand string) error
 		return err
 	}
 
-	fmt.Printf("Executing %s command...\n", subCommand)
+	logger.Infof("Executing %s command...", subCommand)
 
 	packCommand := exec.Command("distrobuilder",
-		subCommand, imageFile, rootfsDir, dateDir,
-		"--cache-dir", cacheDir)
+		append([]string{subCommand, imageFile, rootfsDir, dateDir,
+			"--cache-dir", cacheDir}, overrides...)...)
 
 	packCommand.Stdout = os.Stdout
 	packCommand.Stderr = os.Stderr
 
-	err = packCommand.Run()
+	err = tools.RunCommand(ctx, packCommand, grace)
 	if err != nil {
 		return err
 	}
@@ -244,66 +418,70 @@ func packImage(imageFile, rootfsDir, dateDir, cacheDir, subCommand string) error
 	return nil
 }
 
-func purgeOldImages(productDir string, product *config.SimpleStreamsProduct) error {
+// purgeOldImages removes the old versions of the product and
+// returns the directories removed. The versions are sorted by the
+// creation_date of the metadata or by the date of the directory name.
+func purgeOldImages(productDir string, product *config.SimpleStreamsProduct) ([]string, error) {
 	var err error
+	var purged []string = []string{}
 	var files []os.FileInfo
-	var dates []time.Time
-	var date time.Time
+	var versions []string
+	var dates map[string]time.Time = make(map[string]time.Time, 0)
 	var dateDir string
 
 	// Iterate for every directory
 	files, err = ioutil.ReadDir(productDir)
 	if err != nil {
-		return err
+		return purged, err
 	}
 
-	fmt.Println("Purge directory " + productDir + "...")
+	logger.Info("Purge directory " + productDir + "...")
 
+	types := NewItemTypeRegistry().Types()
 	for _, f := range files {
 
 		if !f.IsDir() || len(f.Name()) < 8 {
 			continue
 		}
 
-		date, err = time.Parse("20060102_15:04", f.Name())
+		date, err := versionBuildDate(types, path.Join(productDir, f.Name()), f.Name())
 		if err != nil {
-			fmt.Println(fmt.Sprintf("Skipping directory %s: %s",
-				f.Name(), err.Error()))
+			logger.Warningf("Skipping directory %s: %s",
+				f.Name(), err.Error())
 			continue
 		}
 
-		// Retrieve hour and minutes
-
-		dates = append(dates, date)
+		versions = append(versions, f.Name())
+		dates[f.Name()] = date
 	}
 
-	// Sort dates
-	sort.Sort(tools.TimeSorter(dates))
+	// Sort versions from the oldest.
+	sort.Slice(versions, func(i, j int) bool {
+		di, dj := dates[versions[i]], dates[versions[j]]
+		if di.Equal(dj) {
+			return versions[i] < versions[j]
+		}
+		return di.Before(dj)
+	})
 
-	fmt.Println(fmt.Sprintf("Found %d dates.", len(dates)))
+	logger.Infof("Found %d dates.", len(versions))
 
 	// PRE: I consider to have only one image for day.
-	for len(dates) > product.Days {
+	for len(versions) > product.Days {
 		// Remove directory old
+		dateDir = path.Join(productDir, versions[0])
 
-		dateDir = path.Join(productDir,
-			fmt.Sprintf("%4d%02d%02d_%02d:%02d",
-				dates[0].Year(),
-				dates[0].Month(),
-				dates[0].Day(),
-				dates[0].Hour(),
-				dates[0].Minute()),
-		)
-
-		fmt.Println(fmt.Sprintf("Removing directory %s...", dateDir))
+		logger.Infof("Removing directory %s...", dateDir)
 		err = os.RemoveAll(dateDir)
 		if err != nil {
-			fmt.Println(fmt.Sprintf("ERROR on remove directory %s: %s",
-				dateDir, err.Error()))
+			logger.Errorf("Error on remove directory %s: %s",
+				dateDir, err.Error())
+		} else {
+			purged = append(purged, dateDir)
 		}
 
-		dates = dates[1:len(dates)]
+		versions = versions[1:]
 	}
 
-	return nil
+	return purged, nil
 }
@@ -0,0 +1,199 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BuildPhaseBuildDir   = "build-dir"
+	BuildPhaseHook       = "hook"
+	BuildPhaseBuildLxc   = "build-lxc"
+	BuildPhaseBuildLxd   = "build-lxd"
+	BuildPhasePackLxc    = "pack-lxc"
+	BuildPhasePackLxd    = "pack-lxd"
+	BuildPhaseBuildIncus = "build-incus"
+	BuildPhasePackIncus  = "pack-incus"
+	BuildPhasePurge      = "purge"
+
+	BuildStatusSuccess     = "success"
+	BuildStatusFailed      = "failed"
+	BuildStatusInterrupted = "interrupted"
+)
+
+// BuildReport is the machine-readable report of a build-product run.
+type BuildReport struct {
+	Product              string          `json:"product"`
+	VersionDir           string          `json:"version_dir,omitempty"`
+	DistrobuilderVersion string          `json:"distrobuilder_version,omitempty"`
+	Definition           string          `json:"definition,omitempty"`
+	StartTime            time.Time       `json:"start_time"`
+	EndTime              time.Time       `json:"end_time"`
+	Duration             float64         `json:"duration_seconds"`
+	Phases               []*BuildPhase   `json:"phases"`
+	Artifacts            []BuildArtifact `json:"artifacts"`
+	Purged               []string        `json:"purged"`
+	Status               string          `json:"status"`
+	Error                string          `json:"error,omitempty"`
+
+	mutex sync.Mutex
+}
+
+// BuildPhase contains the timing of a phase of the build.
+type BuildPhase struct {
+	Name      string    `json:"name"`
+	StartTime time.Time `json:"start_time"`
+	Duration  float64   `json:"duration_seconds"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// BuildArtifact describes a file produced by the build.
+type BuildArtifact struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+func NewBuildReport(product string) *BuildReport {
+	return &BuildReport{
+		Product:   product,
+		StartTime: time.Now(),
+		Phases:    []*BuildPhase{},
+		Artifacts: []BuildArtifact{},
+		Purged:    []string{},
+	}
+}
+
+// Phase executes the function in input and registers the timing
+// of the phase. The report could be nil.
+func (r *BuildReport) Phase(name string, f func() error) error {
+	if r == nil {
+		return f()
+	}
+
+	phase := &BuildPhase{
+		Name:      name,
+		StartTime: time.Now(),
+	}
+
+	err := f()
+
+	phase.Duration = time.Since(phase.StartTime).Seconds()
+	if err != nil {
+		phase.Error = err.Error()
+	}
+
+	r.mutex.Lock()
+	r.Phases = append(r.Phases, phase)
+	r.mutex.Unlock()
+
+	return err
+}
+
+// Done sets the final status of the report.
+func (r *BuildReport) Done(err error, interrupted bool) {
+	if r == nil {
+		return
+	}
+
+	r.EndTime = time.Now()
+	r.Duration = r.EndTime.Sub(r.StartTime).Seconds()
+
+	switch {
+	case err == nil:
+		r.Status = BuildStatusSuccess
+	case interrupted:
+		r.Status = BuildStatusInterrupted
+		r.Error = err.Error()
+	default:
+		r.Status = BuildStatusFailed
+		r.Error = err.Error()
+	}
+}
+
+// AddArtifacts registers the files available under the version directory.
+func (r *BuildReport) AddArtifacts(dir string) error {
+	if r == nil || dir == "" {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		file := path.Join(dir, f.Name())
+		hash, err := fileSha256(file)
+		if err != nil {
+			return err
+		}
+
+		r.Artifacts = append(r.Artifacts, BuildArtifact{
+			Name:   f.Name(),
+			Path:   file,
+			Size:   f.Size(),
+			Sha256: hash,
+		})
+	}
+
+	return nil
+}
+
+func (r *BuildReport) WriteJson(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r *BuildReport) WriteJsonFile(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return r.WriteJson(f)
+}
+
+// DistrobuilderVersion returns the version of the distrobuilder
+// available on PATH.
+func DistrobuilderVersion() (string, error) {
+	out, err := exec.Command("distrobuilder", "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func fileSha256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
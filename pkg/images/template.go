@@ -0,0 +1,157 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+// DefinitionTemplateSuffix is the suffix of the distrobuilder files
+// rendered with the product fields before the build.
+const DefinitionTemplateSuffix = ".tmpl"
+
+// DefinitionTemplateData contains the data available on the
+// definition templates.
+type DefinitionTemplateData struct {
+	Name         string
+	Arch         string
+	Release      string
+	ReleaseTitle string
+	OS           string
+	Directory    string
+	Aliases      []string
+	// Vars of the product.
+	Vars map[string]interface{}
+	// Values of the tree.
+	Values map[string]interface{}
+}
+
+func NewDefinitionTemplateData(product *config.SimpleStreamsProduct, values map[string]interface{}) *DefinitionTemplateData {
+	ans := &DefinitionTemplateData{
+		Name:         product.Name,
+		Arch:         product.Architecture,
+		Release:      product.Release,
+		ReleaseTitle: product.ReleaseTitle,
+		OS:           product.OperatingSystem,
+		Directory:    product.Directory,
+		Aliases:      product.Aliases,
+		Vars:         product.Vars,
+		Values:       values,
+	}
+
+	if ans.Vars == nil {
+		ans.Vars = make(map[string]interface{})
+	}
+	if ans.Values == nil {
+		ans.Values = make(map[string]interface{})
+	}
+
+	return ans
+}
+
+// IsDefinitionTemplate returns true if the file must be rendered
+// before the build.
+func IsDefinitionTemplate(file string) bool {
+	return strings.HasSuffix(file, DefinitionTemplateSuffix)
+}
+
+var definitionTemplateFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": strings.ReplaceAll,
+	"join": func(sep string, elems []string) string {
+		return strings.Join(elems, sep)
+	},
+	"default": func(def, value interface{}) interface{} {
+		if value == nil || value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+// RenderDefinition renders the definition template with the fields
+// of the product. The missing keys are errors and the result must be
+// a valid definition.
+func RenderDefinition(product *config.SimpleStreamsProduct, values map[string]interface{},
+	templateFile string, out io.Writer) error {
+	var buf bytes.Buffer
+
+	data, err := ioutil.ReadFile(templateFile)
+	if err != nil {
+		return err
+	}
+
+	t, err := template.New(path.Base(templateFile)).
+		Option("missingkey=error").
+		Funcs(definitionTemplateFuncs).
+		Parse(string(data))
+	if err != nil {
+		return fmt.Errorf("Error on parse template %s: %s", templateFile, err.Error())
+	}
+
+	err = t.Execute(&buf, NewDefinitionTemplateData(product, values))
+	if err != nil {
+		return fmt.Errorf("Error on render template %s for product %s: %s",
+			templateFile, product.Name, err.Error())
+	}
+
+	_, err = parseDefinition(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Invalid definition rendered from %s for product %s: %s",
+			templateFile, product.Name, err.Error())
+	}
+
+	_, err = out.Write(buf.Bytes())
+	return err
+}
+
+// RenderDefinitionFile renders the definition template under the
+// directory dir and returns the path of the rendered file. The file
+// has the name of the template without the suffix.
+func RenderDefinitionFile(product *config.SimpleStreamsProduct, values map[string]interface{},
+	templateFile, dir string) (string, error) {
+	var buf bytes.Buffer
+
+	err := RenderDefinition(product, values, templateFile, &buf)
+	if err != nil {
+		return "", err
+	}
+
+	ans := path.Join(dir,
+		strings.TrimSuffix(path.Base(templateFile), DefinitionTemplateSuffix))
+	err = ioutil.WriteFile(ans, buf.Bytes(), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return ans, nil
+}
+
+// ReadImageTemplate renders the definition template of the product
+// and returns the definition.
+func ReadImageTemplate(product *config.SimpleStreamsProduct, values map[string]interface{},
+	templateFile string) (*Definition, error) {
+	var buf bytes.Buffer
+
+	if _, err := os.Stat(templateFile); err != nil {
+		return nil, fmt.Errorf("Image file %s not found.", templateFile)
+	}
+
+	err := RenderDefinition(product, values, templateFile, &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDefinition(buf.Bytes())
+}
@@ -21,26 +21,23 @@ package images
 
 import (
 	"bytes"
-	"crypto/md5"
-	"crypto/sha256"
-	"crypto/tls"
-	"encoding/hex"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path"
-	"strconv"
 	"strings"
 	"time"
 
 	v "github.com/spf13/viper"
 
 	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
 	streams "github.com/MottainaiCI/simplestreams-builder/pkg/simplestreams"
+	tools "github.com/MottainaiCI/simplestreams-builder/pkg/tools"
 )
 
 const BYTE_BUFFER_LEN = 256
@@ -56,22 +53,18 @@ type BuildVersionsManifestOptions struct {
 	PrefixPath          string
 	ForceExpireDuration string
 	ImageFile           string
-}
-
-type CombinedSha256Builder struct {
-	SquashFsIsPresent      bool
-	TarXzIsPresent         bool
-	CombinedRootxzSha256   hash.Hash
-	CombinedSquashfsSha256 hash.Hash
-}
-
-func newCombinedSha256Builder() CombinedSha256Builder {
-	return CombinedSha256Builder{
-		SquashFsIsPresent:      false,
-		TarXzIsPresent:         false,
-		CombinedSquashfsSha256: sha256.New(),
-		CombinedRootxzSha256:   sha256.New(),
-	}
+	// Values of the tree used to render the image file if it's a template.
+	Values map[string]interface{}
+	// Registry of the item types. If nil the builtin item types are used.
+	ItemTypes *ItemTypeRegistry
+	// Don't read the metadata.yaml of the metadata tarballs.
+	SkipMetadata bool
+	// Fail if the metadata.yaml is not available or if it doesn't
+	// match with the product. Otherwise a warning is written.
+	StrictMetadata bool
+	// Add also the versions without the items required by the
+	// completeness rules of the product.
+	IncludeIncomplete bool
 }
 
 func BuildVersionsManifest(product *config.SimpleStreamsProduct,
@@ -79,33 +72,65 @@ func BuildVersionsManifest(product *config.SimpleStreamsProduct,
 	var err error
 	var files []os.FileInfo
 	var productBasePath, itemDir, eolDuration string
-	var item, lxdTarXzItem, incusTarXzItem *streams.ProductVersionItem
+	var items map[string]streams.ProductVersionItem
+	var itemTypes []*ItemType
+	var expiry *tools.Expiry
+	// True if the EOL is defined by the options or by the product.
+	var explicitEOL bool = true
+	var created map[string]time.Time = make(map[string]time.Time)
+	var expiries map[string]time.Time = make(map[string]time.Time)
 	var ans *VersionsSSBuilderManifest = &VersionsSSBuilderManifest{
 		Name:     product.Name,
 		Versions: make(map[string]streams.ProductVersion),
 	}
-	var combined CombinedSha256Builder
 
-	if opts.ImageFile != "" && opts.ForceExpireDuration == "" {
+	if opts.ItemTypes == nil {
+		opts.ItemTypes = NewItemTypeRegistry()
+	}
+	itemTypes, err = opts.ItemTypes.ProductItemTypes(product)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ForceExpireDuration != "" {
+		eolDuration = opts.ForceExpireDuration
+	} else if product.SupportEOL != "" {
+		var eol time.Time
+		eol, err = tools.ParseDate(product.SupportEOL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid support_eol for product %s: %s",
+				product.Name, err.Error())
+		}
+		ans.SupportEOL = fmt.Sprintf("%d", eol.Unix())
+		logger.Infof("For product %s use SupportEOL = %s (%s)",
+			product.Name, ans.SupportEOL, product.SupportEOL)
+	} else if product.Expiry != "" {
+		eolDuration = product.Expiry
+	} else {
+		// POST: the expiry_date of the metadata has the precedence
+		// over the image file.
+		explicitEOL = false
+	}
+
+	if !explicitEOL && opts.ImageFile != "" {
 		var imageDef *Definition
-		imageDef, err = ReadImageFile(opts.ImageFile, opts.PrefixPath)
+		if IsDefinitionTemplate(opts.ImageFile) {
+			imageDef, err = ReadImageTemplate(product, opts.Values, opts.ImageFile)
+		} else {
+			imageDef, err = ReadImageFile(opts.ImageFile, opts.PrefixPath)
+		}
 		if err != nil {
-			fmt.Printf("Error on retrieve data from image file %s\n", opts.ImageFile)
+			logger.Errorf("Error on retrieve data from image file %s", opts.ImageFile)
 			return nil, err
 		}
 
 		eolDuration = imageDef.Image.Expiry
-	} else if opts.ForceExpireDuration != "" {
-		eolDuration = opts.ForceExpireDuration
 	}
 
 	if eolDuration != "" {
-		now := time.Now()
-		eol := GetExpiryDate(now, eolDuration)
-		if !now.Equal(eol) {
-			ans.SupportEOL = fmt.Sprintf("%d", eol.Unix())
-			fmt.Printf("For product %s use SupportEOL = %s (%s)\n",
-				product.Name, ans.SupportEOL, eolDuration)
+		expiry, err = tools.ParseExpiry(eolDuration)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -116,7 +141,7 @@ func BuildVersionsManifest(product *config.SimpleStreamsProduct,
 	}
 
 	for _, f := range files {
-		fmt.Println("Check directory " + f.Name())
+		logger.Debug("Check directory " + f.Name())
 		if !f.IsDir() {
 			continue
 		}
@@ -130,7 +155,7 @@ func BuildVersionsManifest(product *config.SimpleStreamsProduct,
 		_, err = time.Parse("20060102", f.Name()[0:8])
 		if err != nil {
 			// Skip directory
-			fmt.Println("Skipping directory " + f.Name())
+			logger.Debug("Skipping directory " + f.Name())
 			continue
 		}
 
@@ -142,134 +167,130 @@ func BuildVersionsManifest(product *config.SimpleStreamsProduct,
 			strings.TrimRight(opts.PrefixPath, "/"),
 			path.Join(product.Directory, f.Name()))
 		itemDir = path.Join(opts.ProductDir, f.Name())
-		combined = newCombinedSha256Builder()
-		fmt.Println(fmt.Sprintf("For product %s I use base path %s.",
-			product.Name, productBasePath))
-
-		lxdTarXzItem, _ = checkItem("lxd.tar.xz", itemDir, productBasePath, &combined)
-		incusTarXzItem, _ = checkItem("incus.tar.xz", itemDir, productBasePath, &combined)
-		item, _ = checkItem("rootfs.squashfs", itemDir, productBasePath, &combined)
-		if item != nil {
-			version.Items["root.squashfs"] = *item
+		logger.Debugf("For product %s I use base path %s.",
+			product.Name, productBasePath)
+
+		items, err = buildVersionItems(itemTypes, itemDir, productBasePath)
+		if err != nil {
+			return nil, err
 		}
-		item, _ = checkItem("rootfs.tar.xz", itemDir, productBasePath, &combined)
-		if item != nil {
-			version.Items["root.tar.xz"] = *item
+		for name, item := range items {
+			version.Items[name] = item
 		}
 
-		if lxdTarXzItem != nil {
-			if combined.SquashFsIsPresent {
-				(*lxdTarXzItem).CombinedHashSha256SquashFs = hex.EncodeToString(
-					combined.CombinedSquashfsSha256.Sum(nil),
-				)
-			}
-
-			if combined.TarXzIsPresent {
-				sha := hex.EncodeToString(combined.CombinedRootxzSha256.Sum(nil))
-				(*lxdTarXzItem).CombinedHashSha256RootXz = sha
-				(*lxdTarXzItem).CombinedHashSha256 = sha
+		err = CheckVersionComplete(product, itemTypes, version.Items)
+		if err != nil {
+			if !opts.IncludeIncomplete {
+				logger.Warningf("Skipping incomplete version %s of product %s: %s",
+					f.Name(), product.Name, err.Error())
+				continue
 			}
-			version.Items["lxd.tar.xz"] = *lxdTarXzItem
+			logger.Warningf("Including incomplete version %s of product %s: %s",
+				f.Name(), product.Name, err.Error())
 		}
 
-		if incusTarXzItem != nil {
-			if combined.SquashFsIsPresent {
-				(*incusTarXzItem).CombinedHashSha256SquashFs = hex.EncodeToString(
-					combined.CombinedSquashfsSha256.Sum(nil),
-				)
+		if !opts.SkipMetadata {
+			m, err := checkVersionMetadata(product, itemTypes, itemDir, opts.StrictMetadata)
+			if err != nil {
+				return nil, err
 			}
-
-			if combined.TarXzIsPresent {
-				sha := hex.EncodeToString(combined.CombinedRootxzSha256.Sum(nil))
-				(*incusTarXzItem).CombinedHashSha256RootXz = sha
-				(*incusTarXzItem).CombinedHashSha256 = sha
+			if m != nil {
+				if !m.Created().IsZero() {
+					created[f.Name()] = m.Created()
+				}
+				if !m.Expiry().IsZero() {
+					expiries[f.Name()] = m.Expiry()
+				}
+				if m.Property("description") != "" {
+					version.Label = m.Property("description")
+				}
 			}
-			version.Items["incus.tar.xz"] = *incusTarXzItem
 		}
 
 		ans.Versions[f.Name()] = version
 	}
 
-	return ans, nil
-}
-
-func checkItem(base, dir, productBasePath string, combined *CombinedSha256Builder) (*streams.ProductVersionItem, error) {
-	var err error
-	var ans *streams.ProductVersionItem
-	var filePath string = fmt.Sprintf("%s/%s", dir, base)
-	var ftype string
-	var f os.FileInfo
-	var fmd5 hash.Hash = md5.New()
-	var fsha hash.Hash = sha256.New()
-	var buf []byte = make([]byte, BYTE_BUFFER_LEN)
-	var pb []byte
-	var nBytes int
-
-	if combined == nil {
-		return nil, fmt.Errorf("Invalid combined struct")
-	}
-
-	if base == "rootfs.squashfs" {
-		ftype = "squashfs"
-		(*combined).SquashFsIsPresent = true
-	} else if base == "lxd.tar.xz" || base == "incus.tar.xz" {
-		ftype = base
-	} else if base == "rootfs.tar.xz" {
-		(*combined).TarXzIsPresent = true
-		ftype = "root.tar.xz"
-	} else {
-		return nil, fmt.Errorf("Unexpected file " + base)
+	// The newest version is the version with the newest creation_date
+	// or with the newest build date of the directory.
+	anchor, newest := newestVersionDate(ans.Versions, created)
+
+	if eol, ok := expiries[newest]; ok && !explicitEOL {
+		ans.SupportEOL = fmt.Sprintf("%d", eol.Unix())
+		logger.Infof("For product %s use SupportEOL = %s (expiry_date of %s)",
+			product.Name, ans.SupportEOL, newest)
+	} else if expiry != nil {
+		// The expiry is anchored to the build date of the newest
+		// version: regenerating the metadata doesn't extend the support.
+		if newest == "" {
+			logger.Debugf("For product %s there aren't versions. SupportEOL not set.",
+				product.Name)
+		} else {
+			eol := expiry.AddTo(anchor)
+			ans.SupportEOL = fmt.Sprintf("%d", eol.Unix())
+			logger.Infof("For product %s use SupportEOL = %s (%s from %s)",
+				product.Name, ans.SupportEOL, eolDuration, newest)
+		}
 	}
 
-	fmt.Println("Check file " + base)
+	return ans, nil
+}
 
-	if f, err = os.Stat(filePath); os.IsNotExist(err) {
-		return nil, err
+// newestVersionDate returns the build date and the name of the
+// newest version. The creation dates of the metadata have the
+// precedence over the name of the version directory.
+func newestVersionDate(versions map[string]streams.ProductVersion,
+	created map[string]time.Time) (time.Time, string) {
+	var ans time.Time
+	var newest string
+
+	for v := range versions {
+		t, ok := created[v]
+		if !ok {
+			var err error
+			t, err = tools.ParseVersionDate(v)
+			if err != nil {
+				continue
+			}
+		}
+		if newest == "" || t.After(ans) || (t.Equal(ans) && v > newest) {
+			ans, newest = t, v
+		}
 	}
 
-	ans = &streams.ProductVersionItem{
-		Path:     fmt.Sprintf("%s/%s", productBasePath, base),
-		FileType: ftype,
-		Size:     f.Size(),
-	}
+	return ans, newest
+}
 
-	file, err := os.OpenFile(filePath, os.O_RDONLY, 0665)
+// checkVersionMetadata reads the metadata of the version and compares
+// it with the product. With strict the errors and the differences are
+// returned, otherwise they are written as warnings.
+func checkVersionMetadata(product *config.SimpleStreamsProduct, types []*ItemType,
+	dir string, strict bool) (*ImageMetadata, error) {
+	m, file, err := readVersionMetadata(types, dir)
 	if err != nil {
-		fmt.Println("Error on read file " + filePath)
-		return nil, err
+		if strict {
+			return nil, err
+		}
+		logger.Warningf("For product %s: %s", product.Name, err.Error())
+		return nil, nil
 	}
-	defer file.Close()
-
-	for {
-		nBytes, err = file.Read(buf)
-
-		if nBytes > 0 {
-			pb = buf[0:nBytes]
-			fmd5.Write(pb)
-			fsha.Write(pb)
-			if base == "lxd.tar.xz" || base == "incus.tar.xz" {
-				(*combined).CombinedRootxzSha256.Write(pb)
-				(*combined).CombinedSquashfsSha256.Write(pb)
-			} else if base == "rootfs.tar.xz" {
-				(*combined).CombinedRootxzSha256.Write(pb)
-			} else if base == "rootfs.squashfs" {
-				(*combined).CombinedSquashfsSha256.Write(pb)
-			}
+	if m == nil {
+		if strict {
+			return nil, fmt.Errorf("No metadata tarball with %s found on %s",
+				ImageMetadataFilename, dir)
 		}
+		return nil, nil
+	}
 
-		if err == io.EOF {
-			err = nil
-			break
-		} else if err != nil {
-			fmt.Println("Error read bytes from file " + filePath)
-			return nil, err
+	problems := m.Check(product)
+	if len(problems) > 0 {
+		msg := fmt.Sprintf("Metadata of %s: %s", file, strings.Join(problems, ", "))
+		if strict {
+			return nil, errors.New(msg)
 		}
+		logger.Warningf("For product %s: %s", product.Name, msg)
 	}
 
-	ans.HashMd5 = hex.EncodeToString(fmd5.Sum(nil))
-	ans.HashSha256 = hex.EncodeToString(fsha.Sum(nil))
-
-	return ans, nil
+	return m, nil
 }
 
 func WriteVersionsManifestJson(manifest *VersionsSSBuilderManifest, out io.Writer) error {
@@ -277,76 +298,24 @@ func WriteVersionsManifestJson(manifest *VersionsSSBuilderManifest, out io.Write
 	return enc.Encode(manifest)
 }
 
+// ReadVersionsManifestJsonFromUrl retrieves the remote manifest with the
+// default http settings. See ManifestFetcher for a configurable client.
 func ReadVersionsManifestJsonFromUrl(url, apiKey string) (*VersionsSSBuilderManifest, error) {
-	var ans *VersionsSSBuilderManifest = nil
-	var req *http.Request = nil
-	var err error
-
-	transport := &http.Transport{
-		Proxy:           http.ProxyFromEnvironment,
-		MaxIdleConns:    5,
-		IdleConnTimeout: 30 * time.Second,
-	}
+	var auth *config.HttpAuthConfig = nil
 
-	// TODO: To refactor
-	skipVerifyCert := os.Getenv("SSBUILDER_INSECURE_SKIPVERIFY")
-	if skipVerifyCert == "1" {
-		fmt.Printf("SSBUILDER_INSECURE_SKIPVERIFY catched for url %s. You know what you do.\n", url)
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	}
-
-	var timeout int = 60
-
-	httpTimeout := os.Getenv("SSBUILDER_HTTP_TIMEOUT")
-	if httpTimeout != "" {
-		t, err := strconv.Atoi(httpTimeout)
-		if err == nil {
-			fmt.Printf("SSBUILDER_HTTP_TIMEOUT available. Using %s\n", httpTimeout)
-			timeout = t
-		} else {
-			fmt.Printf(
-				"SSBUILDER_HTTP_TIMEOUT available. Ignoring wrong value %s\n",
-				httpTimeout)
-		}
-	}
-
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   time.Duration(timeout) * time.Second,
-	}
-
-	req, err = http.NewRequest("GET", url, nil)
+	fetcher, err := NewManifestFetcher(config.HttpClientConfig{
+		Timeout:     60 * time.Second,
+		Concurrency: 1,
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	if apiKey != "" {
-		req.Header.Add("Authorization", "token "+apiKey)
+		auth = &config.HttpAuthConfig{Type: AuthTypeToken, Token: apiKey}
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Invalid response %d for url %s",
-			resp.StatusCode, url)
-	}
-
-	byteValue, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	ans = &VersionsSSBuilderManifest{}
-	err = json.Unmarshal(byteValue, ans)
-	if err != nil {
-		return nil, err
-	}
-
-	return ans, nil
+	return fetcher.Fetch(context.Background(), url, auth)
 }
 
 func ReadVersionsManifestJson(ssbPath string) (*VersionsSSBuilderManifest, error) {
@@ -374,7 +343,6 @@ func ReadImageFile(imageFile, prefixPath string) (*Definition, error) {
 	var err error
 	var image string
 	var ibytes []byte
-	var ans Definition
 
 	if _, err = os.Stat(path.Join(prefixPath, imageFile)); os.IsNotExist(err) {
 		// Check if exists a local image file or through path defined if there is ABS.
@@ -389,21 +357,31 @@ func ReadImageFile(imageFile, prefixPath string) (*Definition, error) {
 	// Read configuration
 	ibytes, err = ioutil.ReadFile(image)
 	if err != nil {
-		fmt.Printf("Error on read file %s!\n", image)
+		logger.Errorf("Error on read file %s!", image)
+		return nil, err
+	}
+
+	ans, err := parseDefinition(ibytes)
+	if err != nil {
+		logger.Errorf("Error on process image file %s: %s", image, err.Error())
 		return nil, err
 	}
 
+	return ans, nil
+}
+
+func parseDefinition(data []byte) (*Definition, error) {
+	var ans Definition
+
 	viper := v.New()
 	viper.SetConfigType("yaml")
-	err = viper.ReadConfig(bytes.NewBuffer(ibytes))
+	err := viper.ReadConfig(bytes.NewBuffer(data))
 	if err != nil {
-		fmt.Printf("Error on process configuration file %s\n", image)
 		return nil, err
 	}
 
 	err = viper.Unmarshal(&ans)
 	if err != nil {
-		fmt.Printf("Error on unmarshal file %s: %s\n", image, err.Error())
 		return nil, err
 	}
 
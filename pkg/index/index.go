@@ -20,10 +20,10 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package index
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"os"
 	"path"
 	"strings"
 
@@ -33,11 +33,20 @@ import (
 )
 
 func BuildIndexStruct(config *config.BuilderTreeConfig, sourceDir string) (*streams.Stream, error) {
+	snapshot, err := images.NewManifestLoader(config, sourceDir).Load(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return BuildIndexStructFromSnapshot(config, snapshot)
+}
+
+// BuildIndexStructFromSnapshot creates the index.json struct from the
+// manifests already loaded.
+func BuildIndexStructFromSnapshot(config *config.BuilderTreeConfig, snapshot *images.ManifestsSnapshot) (*streams.Stream, error) {
 	var ans *streams.Stream
 	var products streams.StreamIndex
-	var ipath, prefix, ssbPath string
-	var manifest *images.VersionsSSBuilderManifest
-	var err error
+	var ipath, prefix string
 
 	if config.DataType == "" {
 		return nil, fmt.Errorf("Invalid datatype")
@@ -59,58 +68,8 @@ func BuildIndexStruct(config *config.BuilderTreeConfig, sourceDir string) (*stre
 		Format: config.Format,
 	}
 
-	for _, v := range config.Products {
-		if v.Hidden {
-			continue
-		}
-
-		// For every product I try to retrieve ssb.json file
-		// for set versions map.
-		if v.PrefixPath != "" {
-
-			ssbPath = fmt.Sprintf("%s/%s/ssb.json",
-				strings.TrimRight(v.PrefixPath, "/"),
-				strings.TrimRight(v.Directory, "/"),
-			)
-			// Fetch and parse remote ssb.json file
-			manifest, err = images.ReadVersionsManifestJsonFromUrl(ssbPath,
-				config.Viper.GetString("apikey"))
-
-		} else {
-			// POST: Try to search ssb.json file under local filesystem.
-
-			if sourceDir == "" {
-				return nil, fmt.Errorf(
-					"Product %s without prefix_path but source-dir is empty.",
-					v.Name)
-			}
-
-			ssbPath = path.Join(sourceDir, v.Directory, "/ssb.json")
-			fmt.Println("ssb Path ", ssbPath)
-
-			if _, err := os.Stat(ssbPath); os.IsNotExist(err) {
-				// POST: Ignore product
-				fmt.Println(fmt.Sprintf("Product %s is skipped. ssb.json file not found.", v.Name))
-				continue
-			}
-
-			// Parse ssb.json file
-			manifest, err = images.ReadVersionsManifestJson(ssbPath)
-		}
-
-		if err != nil {
-			fmt.Println(fmt.Sprintf("Product %s is skipped. Error on parse ssb.json: %s",
-				v.Name, err.Error()))
-			continue
-		}
-
-		if manifest.Name != v.Name {
-			fmt.Println(fmt.Sprintf(
-				"Product %s is skipped. It contains invalid ssb.json file.", v.Name))
-			continue
-		}
-
-		products.Products = append(products.Products, v.Name)
+	for _, pm := range snapshot.Available() {
+		products.Products = append(products.Products, pm.Name)
 	}
 
 	ans = &streams.Stream{
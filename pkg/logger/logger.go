@@ -0,0 +1,223 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level defines the severity of a log message.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarningLevel
+	ErrorLevel
+)
+
+// Fields contains the structured data attached to a log message.
+type Fields map[string]interface{}
+
+// Logger writes leveled messages in text or JSON format. The logs are
+// written to stderr by default so that stdout is reserved to the
+// output requested by the user.
+type Logger struct {
+	mutex sync.Mutex
+	out   io.Writer
+	level Level
+	json  bool
+}
+
+// Entry is a log message with fields not yet written.
+type Entry struct {
+	logger *Logger
+	fields Fields
+}
+
+var defaultLogger = New(os.Stderr)
+
+func New(out io.Writer) *Logger {
+	return &Logger{
+		out:   out,
+		level: InfoLevel,
+	}
+}
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarningLevel:
+		return "warning"
+	case ErrorLevel:
+		return "error"
+	}
+	return "unknown"
+}
+
+// ParseLevel returns the level with the name in input.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DebugLevel, nil
+	case "info", "":
+		return InfoLevel, nil
+	case "warning", "warn":
+		return WarningLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("Invalid log level %s", name)
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.level = level
+}
+
+func (l *Logger) GetLevel() Level {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.level
+}
+
+func (l *Logger) SetJSON(enable bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.json = enable
+}
+
+func (l *Logger) SetOutput(out io.Writer) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out = out
+}
+
+func (l *Logger) WithFields(fields Fields) *Entry {
+	return &Entry{logger: l, fields: fields}
+}
+
+func (l *Logger) log(level Level, fields Fields, msg string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	if l.json {
+		data := make(map[string]interface{}, len(fields)+3)
+		for k, v := range fields {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			data[k] = v
+		}
+		data["time"] = time.Now().Format(time.RFC3339)
+		data["level"] = level.String()
+		data["msg"] = msg
+
+		line, err := json.Marshal(data)
+		if err != nil {
+			line = []byte(fmt.Sprintf(
+				`{"level":"error","msg":"Error on marshal log message: %s"}`,
+				err.Error()))
+		}
+		fmt.Fprintln(l.out, string(line))
+		return
+	}
+
+	var prefix string
+	switch level {
+	case DebugLevel:
+		prefix = "DEBUG: "
+	case WarningLevel:
+		prefix = "WARNING: "
+	case ErrorLevel:
+		prefix = "ERROR: "
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		msg = fmt.Sprintf("%s %s=%v", msg, k, fields[k])
+	}
+
+	fmt.Fprintln(l.out, prefix+msg)
+}
+
+func (l *Logger) Debug(args ...interface{})   { l.log(DebugLevel, nil, sprint(args...)) }
+func (l *Logger) Info(args ...interface{})    { l.log(InfoLevel, nil, sprint(args...)) }
+func (l *Logger) Warning(args ...interface{}) { l.log(WarningLevel, nil, sprint(args...)) }
+func (l *Logger) Error(args ...interface{})   { l.log(ErrorLevel, nil, sprint(args...)) }
+
+func (l *Logger) Debugf(f string, args ...interface{}) {
+	l.log(DebugLevel, nil, fmt.Sprintf(f, args...))
+}
+func (l *Logger) Infof(f string, args ...interface{}) {
+	l.log(InfoLevel, nil, fmt.Sprintf(f, args...))
+}
+func (l *Logger) Warningf(f string, args ...interface{}) {
+	l.log(WarningLevel, nil, fmt.Sprintf(f, args...))
+}
+func (l *Logger) Errorf(f string, args ...interface{}) {
+	l.log(ErrorLevel, nil, fmt.Sprintf(f, args...))
+}
+
+func (e *Entry) Debug(args ...interface{})   { e.logger.log(DebugLevel, e.fields, sprint(args...)) }
+func (e *Entry) Info(args ...interface{})    { e.logger.log(InfoLevel, e.fields, sprint(args...)) }
+func (e *Entry) Warning(args ...interface{}) { e.logger.log(WarningLevel, e.fields, sprint(args...)) }
+func (e *Entry) Error(args ...interface{})   { e.logger.log(ErrorLevel, e.fields, sprint(args...)) }
+
+func (e *Entry) Debugf(f string, args ...interface{}) {
+	e.logger.log(DebugLevel, e.fields, fmt.Sprintf(f, args...))
+}
+func (e *Entry) Infof(f string, args ...interface{}) {
+	e.logger.log(InfoLevel, e.fields, fmt.Sprintf(f, args...))
+}
+func (e *Entry) Warningf(f string, args ...interface{}) {
+	e.logger.log(WarningLevel, e.fields, fmt.Sprintf(f, args...))
+}
+func (e *Entry) Errorf(f string, args ...interface{}) {
+	e.logger.log(ErrorLevel, e.fields, fmt.Sprintf(f, args...))
+}
+
+// sprint joins the arguments with a space like fmt.Println.
+func sprint(args ...interface{}) string {
+	s := fmt.Sprintln(args...)
+	return s[:len(s)-1]
+}
+
+// Default returns the logger used by the package functions.
+func Default() *Logger { return defaultLogger }
+
+func SetLevel(level Level)            { defaultLogger.SetLevel(level) }
+func GetLevel() Level                 { return defaultLogger.GetLevel() }
+func SetJSON(enable bool)             { defaultLogger.SetJSON(enable) }
+func SetOutput(out io.Writer)         { defaultLogger.SetOutput(out) }
+func WithFields(fields Fields) *Entry { return defaultLogger.WithFields(fields) }
+
+func Debug(args ...interface{})   { defaultLogger.log(DebugLevel, nil, sprint(args...)) }
+func Info(args ...interface{})    { defaultLogger.log(InfoLevel, nil, sprint(args...)) }
+func Warning(args ...interface{}) { defaultLogger.log(WarningLevel, nil, sprint(args...)) }
+func Error(args ...interface{})   { defaultLogger.log(ErrorLevel, nil, sprint(args...)) }
+
+func Debugf(f string, args ...interface{})   { defaultLogger.Debugf(f, args...) }
+func Infof(f string, args ...interface{})    { defaultLogger.Infof(f, args...) }
+func Warningf(f string, args ...interface{}) { defaultLogger.Warningf(f, args...) }
+func Errorf(f string, args ...interface{})   { defaultLogger.Errorf(f, args...) }
@@ -0,0 +1,208 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package tools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a cron expression with the fields minute, hour,
+// day of month, month and day of week. The times are in local time.
+type CronSchedule struct {
+	Expr string
+
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// The day of month or the day of week is *. If both are
+	// restricted a day matches if one of the two matches.
+	domStar bool
+	dowStar bool
+}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	// 7 is sunday like 0.
+	{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron expression with five fields. The fields
+// support *, lists (1,15), ranges (1-5), steps (*/10, 0-30/5) and the
+// names of months and days (jan, mon). The macros @yearly, @annually,
+// @monthly, @weekly, @daily, @midnight and @hourly are supported too.
+func ParseCron(expr string) (*CronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("Invalid cron expression %q: expected %d fields, found %d",
+			expr, len(cronFields), len(fields))
+	}
+
+	ans := &CronSchedule{Expr: expr}
+	bits := []*uint64{&ans.minute, &ans.hour, &ans.dom, &ans.month, &ans.dow}
+	for idx, f := range cronFields {
+		b, err := parseCronField(fields[idx], f)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron expression %q: %s", expr, err.Error())
+		}
+		*bits[idx] = b
+	}
+	ans.domStar = fields[2] == "*" || fields[2] == "?"
+	ans.dowStar = fields[4] == "*" || fields[4] == "?"
+
+	// Sunday is 0 and 7.
+	if ans.dow&(1<<7) != 0 {
+		ans.dow |= 1
+	}
+
+	if ans.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("Invalid cron expression %q: it never matches", expr)
+	}
+
+	return ans, nil
+}
+
+func parseCronField(value string, f cronField) (uint64, error) {
+	var ans uint64
+
+	for _, part := range strings.Split(value, ",") {
+		var err error
+		step := 1
+		rng := part
+
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q of %s", part[i+1:], f.name)
+			}
+		}
+
+		start, end := f.min, f.max
+		switch {
+		case rng == "*" || rng == "?":
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+			start, err = cronValue(rng[:i], f)
+			if err != nil {
+				return 0, err
+			}
+			end, err = cronValue(rng[i+1:], f)
+			if err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid range %q of %s", rng, f.name)
+			}
+		default:
+			start, err = cronValue(rng, f)
+			if err != nil {
+				return 0, err
+			}
+			if !strings.Contains(part, "/") {
+				// POST: a value with a step is the start of the range.
+				end = start
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			ans |= 1 << uint(v)
+		}
+	}
+
+	return ans, nil
+}
+
+func cronValue(s string, f cronField) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q of %s", s, f.name)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d of %s out of range %d-%d", v, f.name, f.min, f.max)
+	}
+
+	return v, nil
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t that matches the schedule. A zero
+// time is returned if the schedule doesn't match in the next five years.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s *CronSchedule) String() string {
+	return s.Expr
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	date := func(y int, m time.Month, d, h, min int) time.Time {
+		return time.Date(y, m, d, h, min, 0, 0, time.UTC)
+	}
+	// 2023-05-01 is a monday.
+	from := date(2023, 5, 1, 10, 7)
+
+	tests := []struct {
+		expr     string
+		from     time.Time
+		expected time.Time
+	}{
+		// Steps.
+		{"*/15 * * * *", from, date(2023, 5, 1, 10, 15)},
+		{"0-30/5 * * * *", from, date(2023, 5, 1, 10, 10)},
+		{"0-30/5 * * * *", date(2023, 5, 1, 10, 31), date(2023, 5, 1, 11, 0)},
+		{"5/20 * * * *", date(2023, 5, 1, 10, 45), date(2023, 5, 1, 11, 5)},
+		// Lists and ranges.
+		{"0 8,20 * * *", from, date(2023, 5, 1, 20, 0)},
+		{"30 9-11 * * *", from, date(2023, 5, 1, 10, 30)},
+		// Names.
+		{"0 4 * * mon-fri", date(2023, 5, 5, 10, 0), date(2023, 5, 8, 4, 0)},
+		{"0 0 1 jan *", from, date(2024, 1, 1, 0, 0)},
+		{"0 0 * JUN SAT", from, date(2023, 6, 3, 0, 0)},
+		// 0 and 7 are sunday.
+		{"0 3 * * 7", from, date(2023, 5, 7, 3, 0)},
+		{"0 3 * * 0", from, date(2023, 5, 7, 3, 0)},
+		// With day of month and day of week restricted a day
+		// matches if one of the two matches.
+		{"0 0 15 * fri", from, date(2023, 5, 5, 0, 0)},
+		{"0 0 2 * fri", from, date(2023, 5, 2, 0, 0)},
+		// With one of the two * only the other is used.
+		{"0 0 15 * *", from, date(2023, 5, 15, 0, 0)},
+		{"0 0 * * fri", from, date(2023, 5, 5, 0, 0)},
+		// Leap day.
+		{"0 0 29 2 *", from, date(2024, 2, 29, 0, 0)},
+		// Macros.
+		{"@hourly", from, date(2023, 5, 1, 11, 0)},
+		{"@daily", from, date(2023, 5, 2, 0, 0)},
+		{"@midnight", from, date(2023, 5, 2, 0, 0)},
+		{"@weekly", from, date(2023, 5, 7, 0, 0)},
+		{"@monthly", from, date(2023, 6, 1, 0, 0)},
+		{"@yearly", from, date(2024, 1, 1, 0, 0)},
+		{"@annually", from, date(2024, 1, 1, 0, 0)},
+		// The next run is always after t.
+		{"7 10 * * *", from, date(2023, 5, 2, 10, 7)},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.expr, err)
+			continue
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.expected) {
+			t.Errorf("%s from %s: expected %s, got %s", tt.expr, tt.from, tt.expected, got)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"30-10 * * * *",
+		"* * * foo *",
+		"@reboot",
+		// It never matches.
+		"0 0 31 2 *",
+		"0 0 30 feb *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
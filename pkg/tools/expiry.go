@@ -0,0 +1,156 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	expiryTokenRegex = regexp.MustCompile(`^(\d+)\s*(mo|s|m|h|d|w|y)`)
+	expiryIsoRegex   = regexp.MustCompile(
+		`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+)
+
+// Expiry is a parsed expiry expression. Years, months and days are
+// added with calendar arithmetic, the rest as a fixed duration.
+type Expiry struct {
+	Years    int
+	Months   int
+	Days     int
+	Duration time.Duration
+}
+
+// AddTo returns the expiry date computed from the date t. The years
+// and the months keep the day of the month if possible, otherwise the
+// last day of the month is used (Jan 31 + 1mo is Feb 28).
+func (e *Expiry) AddTo(t time.Time) time.Time {
+	year, month, day := t.Date()
+	hour, min, sec := t.Clock()
+
+	// The day 0 of the next month is the last day of the month.
+	last := time.Date(year+e.Years, month+time.Month(e.Months)+1, 0, 0, 0, 0, 0, t.Location()).Day()
+	if day > last {
+		day = last
+	}
+
+	ans := time.Date(year+e.Years, month+time.Month(e.Months), day,
+		hour, min, sec, t.Nanosecond(), t.Location())
+
+	return ans.AddDate(0, 0, e.Days).Add(e.Duration)
+}
+
+func (e *Expiry) IsZero() bool {
+	return e.Years == 0 && e.Months == 0 && e.Days == 0 && e.Duration == 0
+}
+
+// ParseExpiry parses an expiry expression. The supported formats are:
+//
+//   - a sequence of values with unit s (seconds), m (minutes), h (hours),
+//     d (days), w (weeks), mo (months) and y (years). For example: 1y6mo, 90d.
+//   - an ISO 8601 duration. For example: P1Y6M, P2W, P1DT12H.
+func ParseExpiry(expr string) (*Expiry, error) {
+	var err error
+	var ans *Expiry
+
+	value := strings.TrimSpace(expr)
+	if value == "" {
+		return nil, fmt.Errorf("Empty expiry expression")
+	}
+
+	if value[0] == 'P' {
+		ans, err = parseIsoExpiry(value)
+	} else {
+		ans, err = parseCompactExpiry(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expiry %q: %s", expr, err.Error())
+	}
+
+	if ans.IsZero() {
+		return nil, fmt.Errorf("Invalid expiry %q: the duration is zero", expr)
+	}
+
+	return ans, nil
+}
+
+// ExpiryDate returns the expiry date computed from the date t with
+// the expression expr.
+func ExpiryDate(t time.Time, expr string) (time.Time, error) {
+	e, err := ParseExpiry(expr)
+	if err != nil {
+		return t, err
+	}
+	return e.AddTo(t), nil
+}
+
+func parseCompactExpiry(value string) (*Expiry, error) {
+	ans := &Expiry{}
+	rest := value
+
+	for rest != "" {
+		match := expiryTokenRegex.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected %q. Use a sequence of values with unit s, m, h, d, w, mo, y or an ISO 8601 duration", rest)
+		}
+
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+
+		switch match[2] {
+		case "s":
+			ans.Duration += time.Duration(n) * time.Second
+		case "m":
+			ans.Duration += time.Duration(n) * time.Minute
+		case "h":
+			ans.Duration += time.Duration(n) * time.Hour
+		case "d":
+			ans.Days += n
+		case "w":
+			ans.Days += n * 7
+		case "mo":
+			ans.Months += n
+		case "y":
+			ans.Years += n
+		}
+
+		rest = strings.TrimLeft(rest[len(match[0]):], " ")
+	}
+
+	return ans, nil
+}
+
+func parseIsoExpiry(value string) (*Expiry, error) {
+	match := expiryIsoRegex.FindStringSubmatch(value)
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return nil, fmt.Errorf("invalid ISO 8601 duration")
+	}
+
+	values := make([]int, len(match))
+	for i := 1; i < len(match); i++ {
+		if match[i] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(match[i])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = n
+	}
+
+	return &Expiry{
+		Years:  values[1],
+		Months: values[2],
+		Days:   values[3]*7 + values[4],
+		Duration: time.Duration(values[5])*time.Hour +
+			time.Duration(values[6])*time.Minute +
+			time.Duration(values[7])*time.Second,
+	}, nil
+}
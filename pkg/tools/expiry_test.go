@@ -0,0 +1,81 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected Expiry
+	}{
+		{"6mo", Expiry{Months: 6}},
+		{"1y6mo", Expiry{Years: 1, Months: 6}},
+		{"90d", Expiry{Days: 90}},
+		{"2w", Expiry{Days: 14}},
+		{"1d 12h", Expiry{Days: 1, Duration: 12 * time.Hour}},
+		{"30m", Expiry{Duration: 30 * time.Minute}},
+		{"P1Y6M", Expiry{Years: 1, Months: 6}},
+		{"P2W", Expiry{Days: 14}},
+		{"P1DT12H", Expiry{Days: 1, Duration: 12 * time.Hour}},
+		{"PT30M", Expiry{Duration: 30 * time.Minute}},
+	}
+
+	for _, tt := range tests {
+		e, err := ParseExpiry(tt.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.expr, err)
+			continue
+		}
+		if *e != tt.expected {
+			t.Errorf("%s: expected %+v, got %+v", tt.expr, tt.expected, *e)
+		}
+	}
+}
+
+func TestParseExpiryErrors(t *testing.T) {
+	for _, expr := range []string{"", " ", "P", "PT", "P1DT", "6x", "0d", "P0D", "d", "1y6"} {
+		if e, err := ParseExpiry(expr); err == nil {
+			t.Errorf("%q: expected an error, got %+v", expr, *e)
+		}
+	}
+}
+
+func TestExpiryAddTo(t *testing.T) {
+	date := func(y int, m time.Month, d, h int) time.Time {
+		return time.Date(y, m, d, h, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expr     string
+		from     time.Time
+		expected time.Time
+	}{
+		// The months keep the day of the month if possible.
+		{"1mo", date(2023, 1, 31, 10), date(2023, 2, 28, 10)},
+		{"1mo", date(2024, 1, 31, 10), date(2024, 2, 29, 10)},
+		{"3mo", date(2023, 1, 31, 10), date(2023, 4, 30, 10)},
+		{"1mo", date(2023, 1, 15, 10), date(2023, 2, 15, 10)},
+		{"1y", date(2024, 2, 29, 0), date(2025, 2, 28, 0)},
+		{"1y6mo", date(2023, 8, 31, 0), date(2025, 2, 28, 0)},
+		{"1mo1d", date(2023, 1, 31, 0), date(2023, 3, 1, 0)},
+		{"12mo", date(2023, 12, 31, 0), date(2024, 12, 31, 0)},
+		{"P1DT12H", date(2023, 12, 31, 12), date(2024, 1, 2, 0)},
+		{"2w", date(2023, 2, 20, 0), date(2023, 3, 6, 0)},
+	}
+
+	for _, tt := range tests {
+		got, err := ExpiryDate(tt.from, tt.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.expr, err)
+			continue
+		}
+		if !got.Equal(tt.expected) {
+			t.Errorf("%s from %s: expected %s, got %s", tt.expr, tt.from, tt.expected, got)
+		}
+	}
+}
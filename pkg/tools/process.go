@@ -0,0 +1,46 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package tools
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// RunCommand runs the command in a new process group. When the context
+// is cancelled the signal received (SIGTERM if the context is not
+// created by NotifyContext) is forwarded to the process group and, if
+// the processes are still alive after the grace period, they are killed.
+// On cancellation the error of the context is returned.
+func RunCommand(ctx context.Context, cmd *exec.Cmd, grace time.Duration) error {
+	setProcessGroup(cmd)
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	signalProcessGroup(cmd, ContextSignal(ctx))
+
+	select {
+	case <-done:
+	case <-time.After(grace):
+		killProcessGroup(cmd)
+		<-done
+	}
+
+	return ctx.Err()
+}
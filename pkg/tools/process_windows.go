@@ -0,0 +1,19 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package tools
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) {
+	cmd.Process.Kill()
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
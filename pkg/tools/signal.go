@@ -0,0 +1,61 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package tools
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+type signalKey struct{}
+
+type signalHolder struct {
+	mutex  sync.Mutex
+	signal os.Signal
+}
+
+// NotifyContext returns a context that is cancelled when one of the
+// signals in input is received. After the first signal the default
+// behavior is restored, so a second signal terminates the process
+// immediately. The signal received is returned by ContextSignal.
+func NotifyContext(parent context.Context, signals ...os.Signal) (context.Context, context.CancelFunc) {
+	holder := &signalHolder{}
+	ctx, cancel := context.WithCancel(
+		context.WithValue(parent, signalKey{}, holder))
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+
+	go func() {
+		select {
+		case s := <-ch:
+			holder.mutex.Lock()
+			holder.signal = s
+			holder.mutex.Unlock()
+			signal.Stop(ch)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel()
+	}
+}
+
+// ContextSignal returns the signal that has cancelled the context
+// created by NotifyContext or nil.
+func ContextSignal(ctx context.Context) os.Signal {
+	holder, ok := ctx.Value(signalKey{}).(*signalHolder)
+	if !ok {
+		return nil
+	}
+
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	return holder.signal
+}
@@ -0,0 +1,43 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package tools
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// VersionDirLayout is the layout of the directory of a product version.
+const VersionDirLayout = "20060102_15:04"
+
+// ParseDate parses an absolute date in the formats YYYY-MM-DD,
+// RFC3339 or unix timestamp.
+func ParseDate(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil && len(value) > 8 {
+		return time.Unix(ts, 0).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf(
+		"Invalid date %q. Use YYYY-MM-DD, RFC3339 or unix timestamp", value)
+}
+
+// ParseVersionDate returns the build date of a version from the name
+// of the directory. The directories with only the date prefix YYYYMMDD
+// are accepted too.
+func ParseVersionDate(version string) (time.Time, error) {
+	if t, err := time.ParseInLocation(VersionDirLayout, version, time.Local); err == nil {
+		return t, nil
+	}
+	if len(version) >= 8 {
+		return time.ParseInLocation("20060102", version[0:8], time.Local)
+	}
+	return time.Time{}, fmt.Errorf("Invalid version %s", version)
+}
@@ -66,9 +66,3 @@ func RemoveDirIfNotExist(dir string) error {
 
 	return os.RemoveAll(dir)
 }
-
-func CheckError(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
@@ -0,0 +1,269 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+	images "github.com/MottainaiCI/simplestreams-builder/pkg/images"
+	logger "github.com/MottainaiCI/simplestreams-builder/pkg/logger"
+)
+
+const (
+	// EventProductBuilt is sent when build-product creates a new version.
+	EventProductBuilt = "product-built"
+	// EventVersionsPurged is sent when the purge removes old versions.
+	EventVersionsPurged = "versions-purged"
+	// EventImagesUpdated is sent when build-images-file changes the
+	// versions of a product exposed on images.json.
+	EventImagesUpdated = "images-updated"
+
+	HeaderEvent     = "X-SSB-Event"
+	HeaderDelivery  = "X-SSB-Delivery"
+	HeaderSignature = "X-SSB-Signature-256"
+)
+
+// Payload is the JSON document sent to the webhooks.
+type Payload struct {
+	Event     string     `json:"event"`
+	Timestamp time.Time  `json:"timestamp"`
+	Product   string     `json:"product"`
+	Version   string     `json:"version,omitempty"`
+	Added     []string   `json:"added_versions"`
+	Removed   []string   `json:"removed_versions"`
+	Artifacts []Artifact `json:"artifacts"`
+}
+
+// Artifact is a file of a version published.
+type Artifact struct {
+	Name   string `json:"name"`
+	Url    string `json:"url"`
+	Size   int64  `json:"size,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// Notifier sends the events to the webhooks of the tree.
+type Notifier struct {
+	Config *config.BuilderTreeConfig
+}
+
+type statusError struct {
+	StatusCode int
+	Url        string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Invalid response %d from %s", e.StatusCode, e.Url)
+}
+
+func NewNotifier(c *config.BuilderTreeConfig) *Notifier {
+	return &Notifier{
+		Config: c,
+	}
+}
+
+// Enabled returns true if at least one webhook is configured.
+func (n *Notifier) Enabled() bool {
+	return len(n.Config.Webhooks) > 0
+}
+
+// ArtifactUrl returns the public url of a file with the path relative
+// to the root of the tree.
+func (n *Notifier) ArtifactUrl(relPath string) string {
+	relPath = strings.TrimLeft(relPath, "/")
+	if n.Config.BaseUrl == "" {
+		return relPath
+	}
+	return strings.TrimRight(n.Config.BaseUrl, "/") + "/" + relPath
+}
+
+// Notify sends the payload to the webhooks subscribed to the event.
+// All webhooks are called also if one fails and the first error
+// is returned.
+func (n *Notifier) Notify(ctx context.Context, p *Payload) error {
+	var ans error
+
+	if p.Timestamp.IsZero() {
+		p.Timestamp = time.Now().UTC()
+	}
+	if p.Added == nil {
+		p.Added = []string{}
+	}
+	if p.Removed == nil {
+		p.Removed = []string{}
+	}
+	if p.Artifacts == nil {
+		p.Artifacts = []Artifact{}
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	for idx := range n.Config.Webhooks {
+		w := &n.Config.Webhooks[idx]
+		if !subscribed(w, p.Event) {
+			continue
+		}
+
+		err = n.send(ctx, w, p.Event, body)
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"webhook": w.Name,
+				"event":   p.Event,
+				"product": p.Product,
+			}).Errorf("Error on notify webhook %s: %s", w.Name, err.Error())
+			if ans == nil {
+				ans = err
+			}
+		} else {
+			logger.Debugf("Webhook %s notified for event %s of product %s.",
+				w.Name, p.Event, p.Product)
+		}
+	}
+
+	return ans
+}
+
+func (n *Notifier) send(ctx context.Context, w *config.WebhookConfig, event string, body []byte) error {
+	var err error
+	var secret string
+
+	if w.Secret != "" || w.SecretFile != "" || w.SecretEnv != "" {
+		secret, err = images.ReadSecret(w.Secret, w.SecretFile, w.SecretEnv)
+		if err != nil {
+			return err
+		}
+	}
+
+	timeout, retries, backoff := w.Timeout, w.Retries, w.Backoff
+	if timeout <= 0 {
+		timeout = n.Config.Http.Timeout
+	}
+	if retries == 0 {
+		retries = n.Config.Http.Retries
+	} else if retries < 0 {
+		retries = 0
+	}
+	if backoff <= 0 {
+		backoff = n.Config.Http.Backoff
+	}
+
+	// The proxy of the http settings and the TLS settings of the
+	// tree auth that match the host of the webhook are used.
+	client, err := images.NewHttpClient(config.HttpClientConfig{
+		Proxy:   n.Config.Http.Proxy,
+		Timeout: timeout,
+	}, images.ResolveUrlAuth(n.Config, w.Url))
+	if err != nil {
+		return err
+	}
+	defer client.CloseIdleConnections()
+
+	delivery := newDeliveryId()
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			logger.Warningf("Retry %d/%d of webhook %s in %s: %s",
+				attempt, retries, w.Name, backoff, err.Error())
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			// The backoff is capped like the fetch of the manifests.
+			backoff = backoff * 2
+			if n.Config.Http.MaxBackoff > 0 && backoff > n.Config.Http.MaxBackoff {
+				backoff = n.Config.Http.MaxBackoff
+			}
+		}
+
+		err = n.post(ctx, client, w, event, delivery, secret, body)
+		if err == nil || ctx.Err() != nil || !isTransientError(err) {
+			break
+		}
+	}
+
+	return err
+}
+
+func (n *Notifier) post(ctx context.Context, client *http.Client, w *config.WebhookConfig, event, delivery, secret string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.Url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Invalid url of webhook %s: %s", w.Name, err.Error())
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simplestreams-builder")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderDelivery, delivery)
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	if secret != "" {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{StatusCode: resp.StatusCode, Url: w.Url}
+	}
+
+	return nil
+}
+
+// isTransientError returns true for the timeouts, the connection
+// errors and the responses 429 and 5xx. The other errors are not retried.
+func isTransientError(err error) bool {
+	if serr, ok := err.(*statusError); ok {
+		return images.IsTransientStatus(serr.StatusCode)
+	}
+	return images.IsTransientNetworkError(err)
+}
+
+// Sign returns the hex HMAC-SHA256 of the body. The receiver could
+// verify the X-SSB-Signature-256 header with the same secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func subscribed(w *config.WebhookConfig, event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func newDeliveryId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2019-2023  Daniele Rondina <geaaru@gmail.com>
+*/
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	config "github.com/MottainaiCI/simplestreams-builder/pkg/config"
+)
+
+func newTestNotifier(url string, retries int) *Notifier {
+	c := config.NewBuilderTreeConfig(nil)
+	c.Webhooks = []config.WebhookConfig{
+		{
+			Name:    "test",
+			Url:     url,
+			Secret:  "s3cr3t",
+			Retries: retries,
+			Backoff: time.Millisecond,
+			Timeout: 5 * time.Second,
+		},
+	}
+	return NewNotifier(c)
+}
+
+func TestNotifySignedPayload(t *testing.T) {
+	var got Payload
+	var signature, event string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		event = r.Header.Get(HeaderEvent)
+		if r.Header.Get(HeaderSignature) == "sha256="+Sign("s3cr3t", body) {
+			signature = "valid"
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer srv.Close()
+
+	n := newTestNotifier(srv.URL, 0)
+	err := n.Notify(context.Background(), &Payload{
+		Event:   EventImagesUpdated,
+		Product: "alpine:3.18:amd64:default",
+		Added:   []string{"20231010_10:10"},
+	})
+	if err != nil {
+		t.Fatalf("Notify: %s", err)
+	}
+
+	if event != EventImagesUpdated {
+		t.Errorf("Expected event %s, got %q", EventImagesUpdated, event)
+	}
+	if signature != "valid" {
+		t.Error("Invalid signature of the payload")
+	}
+	if got.Product != "alpine:3.18:amd64:default" || len(got.Added) != 1 {
+		t.Errorf("Unexpected payload %+v", got)
+	}
+}
+
+func TestNotifyRetriesTransientErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	n := newTestNotifier(srv.URL, 3)
+	err := n.Notify(context.Background(), &Payload{Event: EventProductBuilt})
+	if err != nil {
+		t.Fatalf("Notify: %s", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 requests, got %d", calls)
+	}
+}
+
+func TestNotifyNoRetryOnClientErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	n := newTestNotifier(srv.URL, 3)
+	err := n.Notify(context.Background(), &Payload{Event: EventProductBuilt})
+	if err == nil {
+		t.Fatal("Expected an error on 401")
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 request, got %d", calls)
+	}
+}
+
+func TestNotifyRetriesNetworkErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := srv.URL
+	srv.Close()
+
+	n := newTestNotifier(url, 2)
+	err := n.send(context.Background(), &n.Config.Webhooks[0], EventProductBuilt, []byte("{}"))
+	if err == nil {
+		t.Fatal("Expected an error with the server closed")
+	}
+	if !isTransientError(err) {
+		t.Errorf("Expected a network error, got %s", err)
+	}
+}
+
+func TestNotifyBackoffCapped(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	n := newTestNotifier(srv.URL, 6)
+	n.Config.Webhooks[0].Backoff = 20 * time.Millisecond
+	n.Config.Http.MaxBackoff = 20 * time.Millisecond
+
+	// Without the cap the waits are 20ms, 40ms, ... 640ms (1.26s).
+	start := time.Now()
+	n.Notify(context.Background(), &Payload{Event: EventProductBuilt})
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("Backoff not capped: %s for %d requests", elapsed, calls)
+	}
+	if calls != 7 {
+		t.Errorf("Expected 7 requests, got %d", calls)
+	}
+}